@@ -19,11 +19,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/containernetworking/cni/libcni"
 	"github.com/containernetworking/cni/pkg/invoke"
@@ -33,29 +44,91 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 
 	"github.com/qyzhaoxun/multus-cni/pkg/backend"
+	"github.com/qyzhaoxun/multus-cni/pkg/checkpoint"
 	"github.com/qyzhaoxun/multus-cni/pkg/conf"
 	k8s "github.com/qyzhaoxun/multus-cni/pkg/k8sclient"
 	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+	"github.com/qyzhaoxun/multus-cni/pkg/podcache"
 	"github.com/qyzhaoxun/multus-cni/pkg/types"
+	"github.com/qyzhaoxun/multus-cni/pkg/validate"
 )
 
 const (
 	IfNamePrefix = "eth"
+
+	// defaultGCMinAge leaves the entries of ADDs in progress to kubelet
+	defaultGCMinAge = 10 * time.Minute
 )
 
-func saveDelegates(containerID string, delegates []*types.DelegateNetConf, store backend.CNIStore) error {
-	delegatesBytes, err := json.Marshal(delegates)
-	if err != nil {
-		return logging.Errorf("error serializing delegate netconf: %v", err)
+// confDigest hashes the multus configuration without the fields the runtime
+// fills in per invocation, so that the digest only changes with the conf file
+func confDigest(stdinData []byte) string {
+	conf := map[string]json.RawMessage{}
+	if err := json.Unmarshal(stdinData, &conf); err == nil {
+		delete(conf, "runtimeConfig")
+		delete(conf, "prevResult")
+		delete(conf, "args")
+		// the keys of a marshaled map are sorted
+		if data, err := json.Marshal(conf); err == nil {
+			stdinData = data
+		}
 	}
+	digest := sha256.Sum256(stdinData)
+	return hex.EncodeToString(digest[:])
+}
 
-	if err = store.Save(containerID, delegatesBytes); err != nil {
+// newCacheEntry describes the delegates added to the container
+func newCacheEntry(args *skel.CmdArgs, k8sArgs *types.K8sArgs, podUID string, delegates []*types.DelegateNetConf) *types.CacheEntry {
+	entry := &types.CacheEntry{
+		CreatedAt:    time.Now(),
+		PodNamespace: string(k8sArgs.K8S_POD_NAMESPACE),
+		PodName:      string(k8sArgs.K8S_POD_NAME),
+		PodUID:       podUID,
+		Netns:        args.Netns,
+		ConfDigest:   confDigest(args.StdinData),
+	}
+	for _, delegate := range delegates {
+		entry.Delegates = append(entry.Delegates, &types.CacheDelegate{
+			IfName: delegate.IfnameRequest,
+			Conf:   delegate,
+		})
+	}
+	return entry
+}
+
+func saveEntry(containerID string, entry *types.CacheEntry, store backend.CNIStore) error {
+	if err := backend.SaveEntry(store, containerID, entry); err != nil {
 		return logging.Errorf("error in saving delegates : %v", err)
 	}
+	return nil
+}
+
+// setDelegatesDeviceID passes the devices kubelet allocated to the pod to the
+// delegates declaring a resourceName
+func setDelegatesDeviceID(n *types.NetConf, podUID string) error {
+	needDevices := false
+	for _, delegate := range n.Delegates {
+		if delegate.ResourceName != "" {
+			needDevices = true
+			break
+		}
+	}
+	if !needDevices {
+		return nil
+	}
 
-	return err
+	if podUID == "" {
+		return logging.Errorf("setDelegatesDeviceID: pod UID is unknown, can not look up the devices of the pod")
+	}
+	devices, err := checkpoint.GetPodDevices(n.KubeletCheckpointFile, podUID)
+	if err != nil {
+		return err
+	}
+	return conf.SetDelegatesDeviceID(n.Delegates, devices)
 }
 
 func validateIfName(nsname string, ifname string) error {
@@ -79,6 +152,35 @@ func validateIfName(nsname string, ifname string) error {
 	return err
 }
 
+// setNetworkStatusMTU reads the MTU of the status interfaces from the netns,
+// the MTU is informational so errors are only logged
+func setNetworkStatusMTU(nsname string, netStatus []*types.NetworkStatus) {
+	podNs, err := ns.GetNS(nsname)
+	if err != nil {
+		logging.Errorf("setNetworkStatusMTU: no netns: %v", err)
+		return
+	}
+	defer podNs.Close()
+
+	err = podNs.Do(func(_ ns.NetNS) error {
+		for _, status := range netStatus {
+			if status.Interface == "" {
+				continue
+			}
+			link, err := netlink.LinkByName(status.Interface)
+			if err != nil {
+				logging.Errorf("setNetworkStatusMTU: failed to get link %s: %v", status.Interface, err)
+				continue
+			}
+			status.MTU = link.Attrs().MTU
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("setNetworkStatusMTU: %v", err)
+	}
+}
+
 func delegateAdd(exec invoke.Exec, ifName string, delegate *types.DelegateNetConf, rt *libcni.RuntimeConf, binDir string) (cnitypes.Result, error) {
 	logging.Debugf("delegateAdd: %v, %s, %s, %v, %s", exec, ifName, delegate, rt, binDir)
 	if os.Setenv("CNI_IFNAME", ifName) != nil {
@@ -106,14 +208,21 @@ func delegateAdd(exec invoke.Exec, ifName string, delegate *types.DelegateNetCon
 	return result, nil
 }
 
-func delegateDel(exec invoke.Exec, ifName string, delegateConf *types.DelegateNetConf, rt *libcni.RuntimeConf, binDir string) error {
+func delegateDel(exec invoke.Exec, ifName string, delegateConf *types.DelegateNetConf, prevResult []byte, rt *libcni.RuntimeConf, binDir string) error {
 	logging.Debugf("delegateDel: %v, %s, %s, %v, %s", exec, ifName, delegateConf, rt, binDir)
 	if os.Setenv("CNI_IFNAME", ifName) != nil {
 		return logging.Errorf("delegateDel: error in setting CNI_IFNAME")
 	}
 
+	confBytes, err := conf.InjectPrevResult(delegateConf, prevResult)
+	if err != nil {
+		// ignore error, tear down without the prevResult
+		logging.Errorf("delegateDel: error in injecting prevResult - %q: %v", delegateConf.Name(), err)
+		confBytes = delegateConf.Bytes
+	}
+
 	if delegateConf.ConfListPlugin != false {
-		err := conf.ConflistDel(rt, delegateConf.Bytes, binDir)
+		err := conf.ConflistDel(rt, confBytes, binDir)
 		if err != nil {
 			return logging.Errorf("delegateDel: error in invoke Conflist Del - %q: %v", delegateConf.ConfList.Name, err)
 		}
@@ -121,14 +230,154 @@ func delegateDel(exec invoke.Exec, ifName string, delegateConf *types.DelegateNe
 		return err
 	}
 
-	if err := conf.ConfDel(rt, delegateConf.Bytes, binDir); err != nil {
+	if err := conf.ConfDel(rt, confBytes, binDir); err != nil {
 		return logging.Errorf("delegateDel: error in invoke Conf del - %q: %v", delegateConf.Conf.Type, err)
 	}
 
 	return nil
 }
 
-func delPlugins(exec invoke.Exec, delegates []*types.DelegateNetConf, lastIdx int, rt *libcni.RuntimeConf, binDir string) ([]*types.DelegateNetConf, error) {
+func delegateGet(exec invoke.Exec, ifName string, delegateConf *types.DelegateNetConf, prevResult []byte, rt *libcni.RuntimeConf, binDir string) error {
+	logging.Debugf("delegateGet: %v, %s, %s, %v, %s", exec, ifName, delegateConf, rt, binDir)
+	if os.Setenv("CNI_IFNAME", ifName) != nil {
+		return logging.Errorf("delegateGet: error in setting CNI_IFNAME")
+	}
+
+	confBytes, err := conf.InjectPrevResult(delegateConf, prevResult)
+	if err != nil {
+		return logging.Errorf("delegateGet: error in injecting prevResult - %q: %v", delegateConf.Name(), err)
+	}
+
+	if delegateConf.ConfListPlugin != false {
+		if _, err := conf.ConflistGet(rt, confBytes, binDir, exec); err != nil {
+			return logging.Errorf("delegateGet: error in invoke Conflist get - %q: %v", delegateConf.ConfList.Name, err)
+		}
+		return nil
+	}
+
+	if _, err := conf.ConfGet(rt, confBytes, binDir, exec); err != nil {
+		return logging.Errorf("delegateGet: error in invoke Conf get - %q: %v", delegateConf.Conf.Type, err)
+	}
+	return nil
+}
+
+// sameDelegates tells if the ADD plans the delegates of the stored entry,
+// with the same confs and ifnames
+func sameDelegates(delegates []*types.DelegateNetConf, entry *types.CacheEntry) bool {
+	if len(delegates) != len(entry.Delegates) {
+		return false
+	}
+	for idx, delegate := range delegates {
+		stored := entry.Delegates[idx]
+		if delegate.IfnameRequest != stored.IfName || !bytes.Equal(delegate.Bytes, stored.Conf.Bytes) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDelegates runs GET on the stored delegates which the previous ADD
+// finished and returns their ADD results if all of them are still in place.
+// The results stop at the first delegate the previous ADD did not finish.
+func checkDelegates(exec invoke.Exec, args *skel.CmdArgs, k8sArgs *types.K8sArgs, entry *types.CacheEntry, rc map[string]interface{}, binDir string) ([]cnitypes.Result, error) {
+	// libcni rejects the GET of a conf older than 0.4.0, such delegates can't
+	// be checked and are added again
+	for _, delegate := range entry.Delegates {
+		if delegate.Progress() != types.DelegateStateDone {
+			break
+		}
+		confVersion := conf.DelegateVersion(delegate.Conf)
+		if ok, err := version.GreaterThanOrEqualTo(confVersion, "0.4.0"); err != nil || !ok {
+			logging.Infof("checkDelegates: skip GET, network %s has cniVersion %s", delegate.Conf.Name(), confVersion)
+			return nil, fmt.Errorf("network %s has cniVersion %s, GET needs 0.4.0", delegate.Conf.Name(), confVersion)
+		}
+	}
+
+	var results []cnitypes.Result
+	for _, delegate := range entry.Delegates {
+		if delegate.Progress() != types.DelegateStateDone {
+			break
+		}
+		if len(delegate.Result) == 0 {
+			return nil, fmt.Errorf("no result of network %s", delegate.Conf.Name())
+		}
+		result, err := conf.LoadResult(delegate.Result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the result of network %s: %v", delegate.Conf.Name(), err)
+		}
+
+		rt, _ := conf.LoadCNIRuntimeConf(args, k8sArgs, delegate.Conf, rc)
+		if err := delegateGet(exec, delegate.IfName, delegate.Conf, delegate.Result, rt, binDir); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// readdEntry handles an ADD of a container which already has an entry, e.g.
+// kubelet retries an ADD which timed out or multus crashed in. If the stored
+// delegates are the planned ones and the finished ones pass a GET their
+// results are returned to be reused, the delegate which was in progress is
+// torn down and the ADD goes on from it. Otherwise the started delegates are
+// torn down so the ADD starts clean.
+func readdEntry(exec invoke.Exec, args *skel.CmdArgs, k8sArgs *types.K8sArgs, n *types.NetConf, store backend.CNIStore) ([]cnitypes.Result, error) {
+	prev, err := backend.LoadEntry(store, args.ContainerID)
+	if err != nil {
+		if os.IsNotExist(err) || err == backend.ErrCorruptEntry {
+			return nil, nil
+		}
+		return nil, logging.Errorf("readdEntry: Err in reading the delegates: %v", err)
+	}
+
+	logging.Infof("readdEntry: container %s already has delegates %s", args.ContainerID, getDelegateNames(prev.DelegateConfs()))
+	if prev.Netns == args.Netns && sameDelegates(n.Delegates, prev) {
+		results, err := checkDelegates(exec, args, k8sArgs, prev, n.RuntimeConfig, n.BinDir)
+		if err == nil {
+			if err := undoUnfinished(exec, args, k8sArgs, n, prev, len(results)); err != nil {
+				return nil, err
+			}
+			logging.Infof("readdEntry: reuse %d delegates of container %s", len(results), args.ContainerID)
+			return results, nil
+		}
+		logging.Infof("readdEntry: delegates of container %s failed the check: %v", args.ContainerID, err)
+	}
+
+	prev.DropPending()
+	confs := prev.DelegateConfs()
+	eDelegates, err := delPlugins(exec, args, k8sArgs, confs, prev.Results(), len(confs)-1, n.RuntimeConfig, n.BinDir)
+	if err != nil {
+		// keep what is left for the DEL
+		prev.Retain(eDelegates)
+		if err1 := saveEntry(args.ContainerID, prev, store); err1 != nil {
+			logging.Errorf("readdEntry: Err in saving failed delegates: %v", err1)
+		}
+		return nil, logging.Errorf("readdEntry: Err in tearing down the delegates of container %s: %v", args.ContainerID, err)
+	}
+	return nil, nil
+}
+
+// undoUnfinished tears down the started delegates of the entry after the
+// finished ones, i.e. the delegate an interrupted ADD was running. The entry
+// is left as it is if that fails, the DEL tears it down again.
+func undoUnfinished(exec invoke.Exec, args *skel.CmdArgs, k8sArgs *types.K8sArgs, n *types.NetConf, entry *types.CacheEntry, finished int) error {
+	rest := &types.CacheEntry{Delegates: entry.Delegates[finished:]}
+	rest.DropPending()
+	if len(rest.Delegates) == 0 {
+		return nil
+	}
+
+	confs := rest.DelegateConfs()
+	logging.Infof("undoUnfinished: tear down the interrupted delegates %s of container %s", getDelegateNames(confs), args.ContainerID)
+	if _, err := delPlugins(exec, args, k8sArgs, confs, rest.Results(), len(confs)-1, n.RuntimeConfig, n.BinDir); err != nil {
+		return logging.Errorf("undoUnfinished: Err in tearing down the interrupted delegates of container %s: %v", args.ContainerID, err)
+	}
+	return nil
+}
+
+// delPlugins tears down the delegates up to lastIdx in reverse order,
+// prevResults holds the ADD results of the delegates and may be shorter
+func delPlugins(exec invoke.Exec, args *skel.CmdArgs, k8sArgs *types.K8sArgs, delegates []*types.DelegateNetConf, prevResults []json.RawMessage, lastIdx int, rc map[string]interface{}, binDir string) ([]*types.DelegateNetConf, error) {
 	logging.Debugf("delPlugins: %v, %d", exec, lastIdx)
 	if os.Setenv("CNI_COMMAND", "DEL") != nil {
 		return delegates, logging.Errorf("delPlugins: error in setting CNI_COMMAND to DEL")
@@ -138,21 +387,28 @@ func delPlugins(exec invoke.Exec, delegates []*types.DelegateNetConf, lastIdx in
 	var eDelegates []*types.DelegateNetConf
 	for idx := lastIdx; idx >= 0; idx-- {
 		ifName := delegates[idx].IfnameRequest
-		rt.IfName = ifName
-		if err := delegateDel(exec, ifName, delegates[idx], rt, binDir); err != nil {
+		var prevResult []byte
+		if idx < len(prevResults) {
+			prevResult = prevResults[idx]
+		}
+		rt, _ := conf.LoadCNIRuntimeConf(args, k8sArgs, delegates[idx], rc)
+		if err := delegateDel(exec, ifName, delegates[idx], prevResult, rt, binDir); err != nil {
 			errstr = append(errstr, err.Error())
 			eDelegates = append([]*types.DelegateNetConf{delegates[idx]}, eDelegates...)
 		}
 	}
 
 	if len(eDelegates) > 0 {
-		return eDelegates, fmt.Errorf(strings.Join(errstr, ";"))
+		return eDelegates, fmt.Errorf("%s", strings.Join(errstr, ";"))
 	}
 
 	return nil, nil
 }
 
-func setDelegatesIfname(delegates []*types.DelegateNetConf, argsIfname string) error {
+// setDelegatesIfname assigns an ifname to every delegate. In chained mode the
+// args.IfName interface is already created by the previous plugins of the
+// chain, so every delegate is a secondary network.
+func setDelegatesIfname(delegates []*types.DelegateNetConf, argsIfname string, chained bool) error {
 	// set delegates ifname
 	// get delegate which holds args.Ifname
 	firstIndex := -1
@@ -171,18 +427,28 @@ func setDelegatesIfname(delegates []*types.DelegateNetConf, argsIfname string) e
 		}
 	}
 
-	if _, ok := ifs[argsIfname]; !ok {
-		if firstIndex == -1 {
-			return logging.Errorf("Failed to set delegates ifname, all delegates set specific ifname other than %s for k8s", argsIfname)
-		} else {
-			delegates[firstIndex].IfnameRequest = argsIfname
-			ifs[argsIfname] = firstIndex
+	if chained {
+		if _, ok := ifs[argsIfname]; ok {
+			return logging.Errorf("Failed to set delegates ifname, ifname %s is created by the previous plugins of the chain", argsIfname)
+		}
+		for _, delegate := range delegates {
+			delegate.MasterPlugin = false
+		}
+		ifs[argsIfname] = -1
+	} else {
+		if _, ok := ifs[argsIfname]; !ok {
+			if firstIndex == -1 {
+				return logging.Errorf("Failed to set delegates ifname, all delegates set specific ifname other than %s for k8s", argsIfname)
+			} else {
+				delegates[firstIndex].IfnameRequest = argsIfname
+				ifs[argsIfname] = firstIndex
+			}
 		}
-	}
 
-	// set master plugin
-	mIndex := ifs[argsIfname]
-	delegates[mIndex].MasterPlugin = true
+		// set master plugin
+		mIndex := ifs[argsIfname]
+		delegates[mIndex].MasterPlugin = true
+	}
 
 	// get ifName lastIdx
 	lastIdx := 0
@@ -211,6 +477,96 @@ func setDelegatesIfname(delegates []*types.DelegateNetConf, argsIfname string) e
 	return nil
 }
 
+func getDelegateNames(delegates []*types.DelegateNetConf) string {
+	var names []string
+	for _, delegate := range delegates {
+		names = append(names, delegate.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+// maxStatusErrorLen is the longest error message kept in a network status entry
+const maxStatusErrorLen = 256
+
+func truncateError(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	if len(msg) > maxStatusErrorLen {
+		msg = msg[:maxStatusErrorLen-3] + "..."
+	}
+	return msg
+}
+
+// getDelegateNetworkStatus returns a network status entry for a delegate
+// without result
+func getDelegateNetworkStatus(delegate *types.DelegateNetConf, state string, err error) *types.NetworkStatus {
+	return &types.NetworkStatus{
+		Name:      delegate.Name(),
+		Interface: delegate.IfnameRequest,
+		Default:   delegate.MasterPlugin,
+		State:     state,
+		Error:     truncateError(err),
+	}
+}
+
+// getFailedNetworkStatus marks the delegates attempted by a failed ADD. The
+// last one failed, the others were rolled back, or are still attached if
+// tearing them down failed too.
+func getFailedNetworkStatus(delegates []*types.DelegateNetConf, delegatesNetStatus [][]*types.NetworkStatus, eDelegates []*types.DelegateNetConf, addErr error, delErr error) []*types.NetworkStatus {
+	failed := make(map[*types.DelegateNetConf]bool)
+	for _, delegate := range eDelegates {
+		failed[delegate] = true
+	}
+
+	var netStatus []*types.NetworkStatus
+	lastIdx := len(delegates) - 1
+	for idx, delegate := range delegates {
+		switch {
+		case idx == lastIdx:
+			netStatus = append(netStatus, getDelegateNetworkStatus(delegate, types.NetworkStateFailed, addErr))
+		case !failed[delegate]:
+			netStatus = append(netStatus, getDelegateNetworkStatus(delegate, types.NetworkStateRolledBack, nil))
+		case idx < len(delegatesNetStatus):
+			for _, status := range delegatesNetStatus[idx] {
+				status.State = types.NetworkStateOK
+				status.Error = truncateError(delErr)
+				netStatus = append(netStatus, status)
+			}
+		default:
+			netStatus = append(netStatus, getDelegateNetworkStatus(delegate, types.NetworkStateOK, delErr))
+		}
+	}
+	return netStatus
+}
+
+// mergeResult appends the interfaces and IPs of a secondary delegate result to
+// the result returned to the runtime. Routes and DNS of the secondary networks
+// are left out, they must not override the master network ones.
+func mergeResult(result cnitypes.Result, secondary cnitypes.Result) (cnitypes.Result, error) {
+	merged, err := current.NewResultFromResult(result)
+	if err != nil {
+		return nil, err
+	}
+	r, err := current.NewResultFromResult(secondary)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := len(merged.Interfaces)
+	merged.Interfaces = append(merged.Interfaces, r.Interfaces...)
+	for _, ip := range r.IPs {
+		ipc := *ip
+		if ipc.Interface != nil {
+			ipc.Interface = current.Int(*ipc.Interface + offset)
+		}
+		merged.IPs = append(merged.IPs, &ipc)
+	}
+
+	return merged, nil
+}
+
 func cmdAdd(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) (cnitypes.Result, error) {
 	logging.Infof("cmdAdd: {containerId %s, netNs %s, ifName %s, args %s, path %s, stdinData %s}, %v, %v",
 		args.ContainerID, args.Netns, args.IfName, args.Args, args.Path, string(args.StdinData), exec, kubeClient)
@@ -225,58 +581,135 @@ func cmdAdd(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) (cn
 		return nil, logging.Errorf("cmdAdd: Err in getting k8s args: %v", err)
 	}
 
+	store, err := backend.NewCNIStore(n.Store, n.CNIDir)
+	if err != nil {
+		return nil, logging.Errorf("cmdAdd: Err in new store: %v", err)
+	}
+
+	// a DEL of the container waits until the ADD is done
+	if err := store.Lock(args.ContainerID); err != nil {
+		return nil, logging.Errorf("cmdAdd: Err in locking the container: %v", err)
+	}
+	// the lock file goes with the entry of a failed ADD
+	removed := false
+	defer func() {
+		if err := store.Unlock(args.ContainerID, removed); err != nil {
+			logging.Errorf("cmdAdd: Err in unlocking the container: %v", err)
+		}
+	}()
+
 	_, kc, err := k8s.TryLoadK8sDelegates(k8sArgs, n, kubeClient)
 	if err != nil {
 		return nil, logging.Errorf("cmdAdd: Err in loading K8s Delegates k8s args: %v", err)
 	}
 
-	err = setDelegatesIfname(n.Delegates, args.IfName)
+	// multus runs as a chained plugin, the prevResult is the master interface
+	chained := n.PrevResult != nil
+	err = setDelegatesIfname(n.Delegates, args.IfName, chained)
 	if err != nil {
 		return nil, err
 	}
 
-	store, err := backend.NewStore(n.CNIDir)
+	// reject incompatible delegates before any of them is created
+	if err := conf.CheckDelegateVersions(n.Delegates, n.BinDir, exec, n.VersionCacheFile); err != nil {
+		return nil, logging.Errorf("cmdAdd: Err in checking delegate versions: %v", err)
+	}
+
+	// record the pod incarnation the delegates are added for
+	podUID := string(k8sArgs.K8S_POD_UID)
+	if kc != nil && kc.PodUID != "" {
+		podUID = string(kc.PodUID)
+	}
+	if err := setDelegatesDeviceID(n, podUID); err != nil {
+		return nil, logging.Errorf("cmdAdd: Err in setting device IDs: %v", err)
+	}
+
+	// the results of the delegates added by a previous ADD, if they are reused
+	cachedResults, err := readdEntry(exec, args, k8sArgs, n, store)
 	if err != nil {
-		return nil, logging.Errorf("cmdAdd: Err in new store: %v", err)
+		return nil, logging.Errorf("cmdAdd: Err in checking the previous ADD: %v", err)
 	}
 
-	// cache the multus config if we have only Multus delegates
-	if err := saveDelegates(args.ContainerID, n.Delegates, store); err != nil {
+	// journal the progress of the ADD, a DEL or gc after a crash tears down
+	// exactly the started delegates
+	entry := newCacheEntry(args, k8sArgs, podUID, n.Delegates)
+	for _, delegate := range entry.Delegates {
+		delegate.State = types.DelegateStatePending
+	}
+	if err := saveEntry(args.ContainerID, entry, store); err != nil {
 		return nil, logging.Errorf("cmdAdd: Err in saving the delegates: %v", err)
 	}
 
 	var result, tmpResult cnitypes.Result
 	var netStatus []*types.NetworkStatus
 	var rt *libcni.RuntimeConf
+	// network status of every added delegate, indexed like n.Delegates
+	var delegatesNetStatus [][]*types.NetworkStatus
+
+	if chained {
+		result = n.PrevResult
+		if n.Kubeconfig != "" && kc != nil {
+			masterNetStatus, err := conf.LoadNetworkStatus(n.PrevResult, n.Name, args.IfName, true)
+			if err != nil {
+				return nil, logging.Errorf("cmdAdd: Err in load prevResult networks status: %v", err)
+			}
+			setNetworkStatusMTU(args.Netns, masterNetStatus)
+			netStatus = append(netStatus, masterNetStatus...)
+		}
+	}
 
 	var delegate *types.DelegateNetConf
 	var idx int
 	for idx, delegate = range n.Delegates {
-		rt, _ = conf.LoadCNIRuntimeConf(args, k8sArgs, delegate.IfnameRequest, n.RuntimeConfig)
-		tmpResult, err = delegateAdd(exec, delegate.IfnameRequest, delegate, rt, n.BinDir)
+		if idx < len(cachedResults) {
+			tmpResult = cachedResults[idx]
+		} else {
+			// never start a delegate the journal does not know about
+			entry.Delegates[idx].State = types.DelegateStateInProgress
+			if err = saveEntry(args.ContainerID, entry, store); err != nil {
+				break
+			}
+			rt, _ = conf.LoadCNIRuntimeConf(args, k8sArgs, delegate, n.RuntimeConfig)
+			tmpResult, err = delegateAdd(exec, delegate.IfnameRequest, delegate, rt, n.BinDir)
+		}
 		if err != nil {
 			logging.Errorf("cmdAdd: Err in %d delegate exec cni add", idx)
 			break
 		}
+		entry.Delegates[idx].State = types.DelegateStateDone
+		if resultBytes, err1 := json.Marshal(tmpResult); err1 == nil {
+			entry.Delegates[idx].Result = resultBytes
+		} else {
+			logging.Errorf("cmdAdd: Err in serializing %d delegate result: %v", idx, err1)
+		}
+		// ignore error, an in-progress delegate is torn down like a done one
+		if err1 := saveEntry(args.ContainerID, entry, store); err1 != nil {
+			logging.Errorf("cmdAdd: Err in saving the progress of %d delegate: %v", idx, err1)
+		}
 
-		// Master plugin result is always used if present
-		if delegate.MasterPlugin || result == nil {
+		if chained {
+			// secondary results are merged into the prevResult
+			result, err = mergeResult(result, tmpResult)
+			if err != nil {
+				logging.Errorf("cmdAdd: Err in merge %d delegate result: %v", idx, err)
+				break
+			}
+		} else if delegate.MasterPlugin || result == nil {
+			// Master plugin result is always used if present
 			result = tmpResult
 		}
 
 		//create the network status, only in case Multus as kubeconfig
 		if n.Kubeconfig != "" && kc != nil {
-			name := delegate.Conf.Name
-			if delegate.ConfListPlugin {
-				name = delegate.ConfList.Name
-			}
-			delegateNetStatus, err := conf.LoadNetworkStatus(tmpResult, name, delegate.MasterPlugin)
-			if err != nil {
-				logging.Errorf("cmdAdd: Err in load networks status: %v", err)
-				break
+			delegateNetStatus, err1 := conf.LoadNetworkStatus(tmpResult, delegate.Name(), delegate.IfnameRequest, delegate.MasterPlugin)
+			if err1 != nil {
+				// ignore error, the network status is informational
+				logging.Errorf("cmdAdd: Err in load networks status: %v", err1)
+				delegateNetStatus = []*types.NetworkStatus{getDelegateNetworkStatus(delegate, types.NetworkStateOK, nil)}
 			}
+			setNetworkStatusMTU(args.Netns, delegateNetStatus)
 
-			netStatus = append(netStatus, delegateNetStatus)
+			delegatesNetStatus = append(delegatesNetStatus, delegateNetStatus)
 		}
 	}
 
@@ -297,25 +730,47 @@ func cmdAdd(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) (cn
 
 	if err != nil {
 		// Ignore errors; DEL must be idempotent anyway
-		_, err1 := delPlugins(exec, n.Delegates, idx, rt, n.BinDir)
+		eDelegates, err1 := delPlugins(exec, args, k8sArgs, n.Delegates, entry.Results(), idx, n.RuntimeConfig, n.BinDir)
 		if err1 != nil {
-			// TODO cache the multus config if we have only Multus delegates, kubelet would not retry cmd del
-			//if err2 := saveDelegates(args.ContainerID, n.Delegates[:rIdx+1], store); err2 != nil {
-			//	logging.Errorf("cmdAdd: Err in saving failed delegates: %v", err2)
-			//}
 			logging.Errorf("cmdAdd: Err in tearing down failed plugins: %v", err1)
 		}
 
-		// ignore error
-		err3 := store.Remove(args.ContainerID)
-		if err3 != nil {
+		k8s.RecordPodEvent(kc, v1.EventTypeWarning, k8s.EventReasonAttachFailed,
+			fmt.Sprintf("failed to attach network %s: %v", n.Delegates[idx].Name(), err))
+
+		// best effort, explain the failure in the network status annotation
+		if n.Kubeconfig != "" && kc != nil {
+			netStatus = append(netStatus, getFailedNetworkStatus(n.Delegates[:idx+1], delegatesNetStatus, eDelegates, err, err1)...)
+			if err2 := k8s.SetNetworkStatus(kc, netStatus); err2 != nil {
+				logging.Errorf("cmdAdd: Err set the failed networks status: %v", err2)
+			}
+		}
+
+		if err1 != nil {
+			// keep the delegates still attached for the DEL or gc
+			entry.Retain(eDelegates)
+			if err2 := saveEntry(args.ContainerID, entry, store); err2 != nil {
+				// ignore error
+				logging.Errorf("cmdAdd: Err in saving failed delegates: %v", err2)
+			}
+		} else if err3 := store.Remove(args.ContainerID); err3 != nil {
+			// ignore error
 			logging.Errorf("cmdAdd: Err in clean net conf: %v", err3)
+		} else {
+			removed = true
 		}
 		return nil, logging.Errorf("cmdAdd: Err in setup plugins: %v", err)
 	}
 
 	//set the network status annotation in apiserver, only in case Multus as kubeconfig
 	if n.Kubeconfig != "" && kc != nil {
+		for _, delegateNetStatus := range delegatesNetStatus {
+			for _, status := range delegateNetStatus {
+				k8s.RecordPodEvent(kc, v1.EventTypeNormal, k8s.EventReasonAttached,
+					fmt.Sprintf("attached network %s as %s with %s", status.Name, status.Interface, strings.Join(status.IPs, ",")))
+			}
+			netStatus = append(netStatus, delegateNetStatus...)
+		}
 		err = k8s.SetNetworkStatus(kc, netStatus)
 		if err != nil {
 			// ignore error
@@ -354,48 +809,522 @@ func cmdDel(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) err
 		return logging.Errorf("cmdDel: Err in getting k8s args: %v", err)
 	}
 
-	store, err := backend.NewStore(n.CNIDir)
+	store, err := backend.NewCNIStore(n.Store, n.CNIDir)
 	if err != nil {
 		return logging.Errorf("cmdDel: Err in new store: %v", err)
 	}
 
+	// wait for an ADD of the container in progress
+	if err := store.Lock(args.ContainerID); err != nil {
+		return logging.Errorf("cmdDel: Err in locking the container: %v", err)
+	}
+	// the lock file goes once the container has no entry left
+	removed := false
+	defer func() {
+		if err := store.Unlock(args.ContainerID, removed); err != nil {
+			logging.Errorf("cmdDel: Err in unlocking the container: %v", err)
+		}
+	}()
+
 	// re-read the scratch multus config if we have only Multus delegates
-	netconfBytes, err := store.Load(args.ContainerID)
-	if err != nil {
+	entry, err := backend.LoadEntry(store, args.ContainerID)
+	removed = os.IsNotExist(err) || err == backend.ErrCorruptEntry
+	if n.RecoverDel && (os.IsNotExist(err) || err == backend.ErrCorruptEntry) {
+		// tear down what the ADD may have created instead of leaking it
+		if entry, err = recoverEntry(args, k8sArgs, n, kubeClient); err != nil {
+			return logging.Errorf("cmdDel: Err in recovering the delegates: %v", err)
+		}
+		if entry == nil {
+			return nil
+		}
+	} else if err != nil {
 		if os.IsNotExist(err) {
 			// Per spec should ignore error if resources are missing / already removed
 			return nil
 		}
+		if err == backend.ErrCorruptEntry {
+			// the entry is quarantined, failing would make kubelet retry forever
+			logging.Errorf("cmdDel: delegates of container %s are corrupt, skip tearing down: %v", args.ContainerID, err)
+			return nil
+		}
 		return logging.Errorf("cmdDel: Err in reading the delegates: %v", err)
 	}
 
-	if err := json.Unmarshal(netconfBytes, &n.Delegates); err != nil {
-		return logging.Errorf("cmdDel: failed to load netconf: %v", err)
-	}
+	// the delegates an interrupted ADD did not start have nothing to tear down
+	entry.DropPending()
+	n.Delegates = entry.DelegateConfs()
 
-	rt, _ := conf.LoadCNIRuntimeConf(args, k8sArgs, "", n.RuntimeConfig)
+	kc, err := k8s.GetClientInfo(k8sArgs, n, kubeClient)
+	if err != nil {
+		// ignore error, the client is only used for events
+		logging.Errorf("cmdDel: Err in getting k8s client: %v", err)
+	}
+	if kc != nil && kc.PodUID == "" {
+		// events go to the pod incarnation the delegates were added for
+		kc.PodUID = k8stypes.UID(entry.PodUID)
+	}
 
 	// Ignore errors; DEL must be idempotent anyway
-	eDelegates, err := delPlugins(exec, n.Delegates, len(n.Delegates)-1, rt, n.BinDir)
+	eDelegates, err := delPlugins(exec, args, k8sArgs, n.Delegates, entry.Results(), len(n.Delegates)-1, n.RuntimeConfig, n.BinDir)
 	if err != nil {
+		k8s.RecordPodEvent(kc, v1.EventTypeWarning, k8s.EventReasonDetachFailed,
+			fmt.Sprintf("failed to detach networks %s: %v", getDelegateNames(eDelegates), err))
+
 		// cache the multus config, kubelet wil retry cmdDel
-		if err1 := saveDelegates(args.ContainerID, eDelegates, store); err1 != nil {
+		entry.Retain(eDelegates)
+		if err1 := saveEntry(args.ContainerID, entry, store); err1 != nil {
 			// ignore error
 			logging.Errorf("cmdDel: Err in saving failed delegates: %v", err1)
+		} else {
+			removed = false
 		}
 		return logging.Errorf("cmdDel: Err in tearing down plugins: %v", err)
 	}
 
-	// ignore error
+	k8s.RecordPodEvent(kc, v1.EventTypeNormal, k8s.EventReasonDetached,
+		fmt.Sprintf("detached networks %s", getDelegateNames(n.Delegates)))
+
+	// ignore error, a recovered entry is not in the store
 	err = store.Remove(args.ContainerID)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		logging.Errorf("cmdDel: Err in clean net conf: %v", err)
+	} else {
+		removed = true
 	}
 
 	return nil
 }
 
+// recoverEntry rebuilds the delegates of a container whose store entry is
+// lost with the same ifnames as the ADD, it returns nil if there are none
+func recoverEntry(args *skel.CmdArgs, k8sArgs *types.K8sArgs, n *types.NetConf, kubeClient k8s.KubeClient) (*types.CacheEntry, error) {
+	_, kc, err := k8s.TryLoadDelDelegates(k8sArgs, n, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.Delegates) == 0 {
+		logging.Infof("recoverEntry: no delegates to tear down for container %s", args.ContainerID)
+		return nil, nil
+	}
+
+	if err := setDelegatesIfname(n.Delegates, args.IfName, n.PrevResult != nil); err != nil {
+		return nil, err
+	}
+
+	podUID := string(k8sArgs.K8S_POD_UID)
+	if kc != nil && kc.PodUID != "" {
+		podUID = string(kc.PodUID)
+	}
+	if err := setDelegatesDeviceID(n, podUID); err != nil {
+		// ignore error, kubelet may have released the devices of the pod
+		logging.Errorf("recoverEntry: Err in setting device IDs: %v", err)
+	}
+
+	logging.Infof("recoverEntry: recovered delegates %s of container %s", getDelegateNames(n.Delegates), args.ContainerID)
+	return newCacheEntry(args, k8sArgs, podUID, n.Delegates), nil
+}
+
+// cmdValidate implements "multus validate", it reports every problem of the
+// multus config and the network files and returns the exit code
+func cmdValidate(arguments []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	confFile := flags.String("conf", validate.DefaultConfFile, "path of the multus config file")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	// only print the report
+	logging.SetLogStderr(false)
+
+	errs := validate.Validate(*confFile)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *confFile, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(errs))
+		return 1
+	}
+
+	fmt.Printf("%s: ok\n", *confFile)
+	return 0
+}
+
+// cmdPodCache runs the node pod cache daemon, which serves the pods of this
+// node to the multus invocations over a unix socket
+func cmdPodCache(arguments []string) int {
+	flags := flag.NewFlagSet("podcache", flag.ContinueOnError)
+	confFile := flags.String("conf", validate.DefaultConfFile, "path of the multus config file")
+	nodeName := flags.String("node", os.Getenv("NODE_NAME"), "name of this node, defaults to $NODE_NAME or the hostname")
+	socket := flags.String("socket", "", "path of the unix socket, defaults to podCacheSocket of the multus config")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	bytes, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		logging.Errorf("cmdPodCache: failed to read multus config: %v", err)
+		return 1
+	}
+	n, err := conf.LoadNetConf(bytes, false)
+	if err != nil {
+		logging.Errorf("cmdPodCache: %v", err)
+		return 1
+	}
+	if *socket == "" {
+		*socket = n.PodCacheSocket
+	}
+	if *socket == "" {
+		*socket = podcache.DefaultSocket
+	}
+	if *nodeName == "" {
+		if *nodeName, err = os.Hostname(); err != nil {
+			logging.Errorf("cmdPodCache: failed to get hostname: %v", err)
+			return 1
+		}
+	}
+
+	// kubeTimeout bounds the requests of a CNI command, the http client would
+	// cut the long running watch of the daemon, which bounds it by itself
+	n.KubeTimeout = 0
+	client, err := k8s.GetK8sClientset(n)
+	if err != nil {
+		logging.Errorf("cmdPodCache: %v", err)
+		return 1
+	}
+	if client == nil {
+		logging.Errorf("cmdPodCache: no kubeconfig in %s and not running in a pod", *confFile)
+		return 1
+	}
+
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		close(stopCh)
+	}()
+
+	cache := podcache.NewCache(podcache.NewNodePodSource(client, *nodeName))
+	go cache.Run(stopCh)
+	if err := podcache.Serve(*socket, cache, stopCh); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// readContainerIDs reads the IDs of the live containers, one per line
+func readContainerIDs(r io.Reader) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			ids[id] = true
+		}
+	}
+	return ids, scanner.Err()
+}
+
+// staleReason tells why the entry of the container is stale, it is empty if
+// the container may be alive. The entry of an interrupted ADD is stale, with
+// live set the entry is stale if the container is not in it, otherwise if the
+// recorded netns does not exist.
+// Entries younger than minAge are never stale, their ADD may have raced with
+// listing the live containers.
+func staleReason(id string, entry *types.CacheEntry, live map[string]bool, minAge time.Duration, now time.Time) string {
+	if !entry.CreatedAt.IsZero() && now.Sub(entry.CreatedAt) < minAge {
+		return ""
+	}
+
+	// multus crashed in the ADD, kubelet does not use the half attached
+	// container and the DEL undoes the started delegates
+	if entry.Interrupted() {
+		return "ADD was interrupted"
+	}
+
+	if live != nil {
+		if !live[id] {
+			return "container is not alive"
+		}
+		return ""
+	}
+
+	// entries of older multus do not record the netns
+	if entry.Netns == "" {
+		return ""
+	}
+	if _, err := os.Stat(entry.Netns); os.IsNotExist(err) {
+		return fmt.Sprintf("netns %s does not exist", entry.Netns)
+	}
+	return ""
+}
+
+// gcArgs are the args of the DEL of a stale entry, as kubelet would pass them
+func gcArgs(id string, entry *types.CacheEntry, stdinData []byte) *skel.CmdArgs {
+	ifName := IfNamePrefix + "0"
+	if len(entry.Delegates) > 0 && entry.Delegates[0].IfName != "" {
+		ifName = entry.Delegates[0].IfName
+	}
+	return &skel.CmdArgs{
+		ContainerID: id,
+		Netns:       entry.Netns,
+		IfName:      ifName,
+		Args: fmt.Sprintf("IgnoreUnknown=1;K8S_POD_NAMESPACE=%s;K8S_POD_NAME=%s;K8S_POD_INFRA_CONTAINER_ID=%s;K8S_POD_UID=%s",
+			entry.PodNamespace, entry.PodName, id, entry.PodUID),
+		StdinData: stdinData,
+	}
+}
+
+// cmdGC implements "multus gc", it runs DEL for the entries of the store
+// whose container is gone and returns the exit code
+func cmdGC(arguments []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	confFile := flags.String("conf", validate.DefaultConfFile, "path of the multus config file")
+	liveFile := flags.String("live", "", "file with the IDs of the live containers, one per line, - for stdin. If unset an entry is stale if its netns does not exist")
+	minAge := flags.Duration("min-age", defaultGCMinAge, "never collect entries younger than this")
+	dryRun := flags.Bool("dry-run", false, "only print the stale entries")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	bytes, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		logging.Errorf("cmdGC: failed to read multus config: %v", err)
+		return 1
+	}
+	n, err := conf.LoadNetConf(bytes, false)
+	if err != nil {
+		logging.Errorf("cmdGC: %v", err)
+		return 1
+	}
+
+	var live map[string]bool
+	if *liveFile != "" {
+		r := os.Stdin
+		if *liveFile != "-" {
+			f, err := os.Open(*liveFile)
+			if err != nil {
+				logging.Errorf("cmdGC: failed to open the live containers: %v", err)
+				return 1
+			}
+			defer f.Close()
+			r = f
+		}
+		if live, err = readContainerIDs(r); err != nil {
+			logging.Errorf("cmdGC: failed to read the live containers: %v", err)
+			return 1
+		}
+	}
+
+	store, err := backend.NewCNIStore(n.Store, n.CNIDir)
+	if err != nil {
+		logging.Errorf("cmdGC: Err in new store: %v", err)
+		return 1
+	}
+	ids, err := store.List()
+	if err != nil {
+		logging.Errorf("cmdGC: Err in listing the store: %v", err)
+		return 1
+	}
+
+	// ignore error, the client is only used for events
+	kubeClient, err := k8s.GetK8sClient(n, nil)
+	if err != nil {
+		logging.Errorf("cmdGC: Err in getting k8s client: %v", err)
+	}
+
+	now := time.Now()
+	stale, failed := 0, 0
+	for _, id := range ids {
+		entry, err := backend.LoadEntry(store, id)
+		if err != nil {
+			// removed by a DEL in the meantime, or quarantined
+			if !os.IsNotExist(err) {
+				logging.Errorf("cmdGC: skip %s: %v", id, err)
+			}
+			continue
+		}
+		reason := staleReason(id, entry, live, *minAge, now)
+		if reason == "" {
+			continue
+		}
+
+		stale++
+		fmt.Printf("%s: pod %s/%s: %s\n", id, entry.PodNamespace, entry.PodName, reason)
+		if *dryRun {
+			continue
+		}
+		// DEL removes the entry once all delegates are torn down
+		if err := cmdDel(gcArgs(id, entry, bytes), nil, kubeClient); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			failed++
+		}
+	}
+
+	// both stores save through temp files in the cniDir
+	temps, err := backend.RemoveTempFiles(n.CNIDir, *minAge, *dryRun)
+	if err != nil {
+		logging.Errorf("cmdGC: Err in removing temp files: %v", err)
+	}
+	for _, name := range temps {
+		fmt.Printf("%s: temp file of an interrupted save\n", name)
+	}
+
+	if *dryRun {
+		fmt.Printf("%d of %d entries are stale\n", stale, len(ids))
+		return 0
+	}
+	if bs, ok := store.(*backend.BoltStore); ok {
+		// give the space of the removed entries back
+		if err := bs.Compact(); err != nil {
+			logging.Errorf("cmdGC: Err in compacting the store: %v", err)
+		}
+	}
+	fmt.Printf("%d of %d entries are stale, %d collected\n", stale, len(ids), stale-failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// entryNetworks returns the networks of the entry as name@ifname
+func entryNetworks(entry *types.CacheEntry) []string {
+	var networks []string
+	for _, delegate := range entry.Delegates {
+		networks = append(networks, fmt.Sprintf("%s@%s", delegate.Conf.Name(), delegate.IfName))
+	}
+	return networks
+}
+
+// entryHasNetwork tells if a delegate of the entry is the network
+func entryHasNetwork(entry *types.CacheEntry, network string) bool {
+	for _, delegate := range entry.Delegates {
+		if delegate.Conf.Name() == network {
+			return true
+		}
+	}
+	return false
+}
+
+// listedEntry is a line of "multus ls"
+type listedEntry struct {
+	ContainerID string    `json:"containerID"`
+	Pod         string    `json:"pod,omitempty"`
+	PodUID      string    `json:"podUID,omitempty"`
+	Networks    []string  `json:"networks"`
+	Created     time.Time `json:"created"`
+	Size        int64     `json:"size"`
+}
+
+// cmdList implements "multus ls", it prints the containers multus attached
+// networks to from the store and returns the exit code
+func cmdList(arguments []string) int {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	confFile := flags.String("conf", validate.DefaultConfFile, "path of the multus config file")
+	network := flags.String("network", "", "only list the containers attached to this network")
+	pod := flags.String("pod", "", "only list the containers of this pod, namespace/name")
+	jsonOutput := flags.Bool("json", false, "print a json array")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	// only print the list
+	logging.SetLogStderr(false)
+
+	bytes, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read multus config: %v\n", err)
+		return 1
+	}
+	n, err := conf.LoadNetConf(bytes, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	store, err := backend.NewCNIStore(n.Store, n.CNIDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open the store: %v\n", err)
+		return 1
+	}
+	ids, err := store.List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list the store: %v\n", err)
+		return 1
+	}
+
+	entries := []*listedEntry{}
+	for _, id := range ids {
+		info, err := store.Stat(id)
+		if err != nil {
+			// removed by a DEL in the meantime
+			continue
+		}
+		entry, err := backend.LoadEntry(store, id)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			}
+			continue
+		}
+		// entries of older multus do not record the pod
+		podName := ""
+		if entry.PodName != "" {
+			podName = entry.PodNamespace + "/" + entry.PodName
+		}
+		if *network != "" && !entryHasNetwork(entry, *network) || *pod != "" && podName != *pod {
+			continue
+		}
+
+		created := entry.CreatedAt
+		if created.IsZero() {
+			// entries of older multus record no creation time
+			created = info.ModTime
+		}
+		entries = append(entries, &listedEntry{
+			ContainerID: id,
+			Pod:         podName,
+			PodUID:      entry.PodUID,
+			Networks:    entryNetworks(entry),
+			Created:     created,
+			Size:        info.Size,
+		})
+	}
+
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return 1
+		}
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tPOD\tNETWORKS\tCREATED")
+	for _, e := range entries {
+		podName, created := "-", "-"
+		if e.Pod != "" {
+			podName = e.Pod
+		}
+		if !e.Created.IsZero() {
+			created = e.Created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.ContainerID, podName, strings.Join(e.Networks, ","), created)
+	}
+	w.Flush()
+	return 0
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(cmdValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "podcache" {
+		os.Exit(cmdPodCache(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Exit(cmdGC(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ls" {
+		os.Exit(cmdList(os.Args[2:]))
+	}
+
 	skel.PluginMain(
 		func(args *skel.CmdArgs) error {
 			result, err := cmdAdd(args, nil, nil)
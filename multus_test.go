@@ -16,6 +16,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -24,14 +25,18 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 
+	"github.com/qyzhaoxun/multus-cni/pkg/backend"
 	testhelpers "github.com/qyzhaoxun/multus-cni/pkg/testing"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -48,6 +53,8 @@ type fakePlugin struct {
 	expectedIfname string
 	result         cnitypes.Result
 	err            error
+	// hook runs before the plugin returns
+	hook func()
 }
 
 type fakeExec struct {
@@ -55,17 +62,20 @@ type fakeExec struct {
 
 	addIndex int
 	delIndex int
+	getIndex int
 	plugins  []*fakePlugin
 }
 
-func (f *fakeExec) addPlugin(expectedEnv []string, expectedIfname, expectedConf string, result *types020.Result, err error) {
-	f.plugins = append(f.plugins, &fakePlugin{
+func (f *fakeExec) addPlugin(expectedEnv []string, expectedIfname, expectedConf string, result cnitypes.Result, err error) *fakePlugin {
+	plugin := &fakePlugin{
 		expectedEnv:    expectedEnv,
 		expectedConf:   expectedConf,
 		expectedIfname: expectedIfname,
 		result:         result,
 		err:            err,
-	})
+	}
+	f.plugins = append(f.plugins, plugin)
+	return plugin
 }
 
 func matchArray(a1, a2 []string) {
@@ -98,6 +108,21 @@ func gatherCNIEnv() []string {
 
 func (f *fakeExec) ExecPlugin(pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
 	cmd := os.Getenv("CNI_COMMAND")
+	for _, env := range environ {
+		// libcni puts the command of the invocation before the process
+		// environment
+		if strings.HasPrefix(env, "CNI_COMMAND=") {
+			cmd = strings.TrimPrefix(env, "CNI_COMMAND=")
+			break
+		}
+	}
+	// VERSION is sent by multus itself to check the delegate cniVersion
+	if cmd == "VERSION" {
+		var buf bytes.Buffer
+		Expect(version.All.Encode(&buf)).To(Succeed())
+		return buf.Bytes(), nil
+	}
+
 	var index int
 	switch cmd {
 	case "ADD":
@@ -108,6 +133,10 @@ func (f *fakeExec) ExecPlugin(pluginPath string, stdinData []byte, environ []str
 		Expect(len(f.plugins)).To(BeNumerically(">", f.delIndex))
 		index = len(f.plugins) - f.delIndex - 1
 		f.delIndex++
+	case "GET":
+		Expect(len(f.plugins)).To(BeNumerically(">", f.getIndex))
+		index = f.getIndex
+		f.getIndex++
 	default:
 		// Should never be reached
 		Expect(false).To(BeTrue())
@@ -125,6 +154,9 @@ func (f *fakeExec) ExecPlugin(pluginPath string, stdinData []byte, environ []str
 	if len(plugin.expectedEnv) > 0 {
 		matchArray(gatherCNIEnv(), plugin.expectedEnv)
 	}
+	if plugin.hook != nil {
+		plugin.hook()
+	}
 
 	if plugin.err != nil {
 		return nil, plugin.err
@@ -143,20 +175,25 @@ func (f *fakeExec) FindInPath(plugin string, paths []string) (string, error) {
 var _ = Describe("multus operations", func() {
 	var testNS ns.NetNS
 	var tmpDir string
+	var binDir string
 
 	BeforeEach(func() {
 		// Create a new NetNS so we don't modify the host
 		var err error
-		//testNS, err = testutils.NewNS()
+		testNS, err = ns.NewNS()
 		Expect(err).NotTo(HaveOccurred())
 		os.Setenv("CNI_NETNS", testNS.Path())
 		os.Setenv("CNI_PATH", "/some/path")
 
 		tmpDir, err = ioutil.TempDir("", "multus_tmp")
 		Expect(err).NotTo(HaveOccurred())
+		// the DEL of the delegates runs the plugin files
+		binDir = filepath.Join(tmpDir, "bin")
+		writeFakePlugins(binDir, "weave-net", "other-plugin", "third-plugin")
 	})
 
 	AfterEach(func() {
+		removeCachedResults("123456789")
 		Expect(testNS.Close()).To(Succeed())
 		os.Unsetenv("CNI_PATH")
 		os.Unsetenv("CNI_ARGS")
@@ -164,14 +201,15 @@ var _ = Describe("multus operations", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
-	It("executes delegates", func() {
-		args := &skel.CmdArgs{
-			ContainerID: "123456789",
-			Netns:       testNS.Path(),
-			IfName:      "eth0",
-			StdinData: []byte(`{
+	// delegatesConf is a multus config with the inline delegates weave1,
+	// other1 and third1
+	delegatesConf := func(extra string) []byte {
+		return []byte(fmt.Sprintf(`{
     "name": "node-cni-network",
     "type": "multus",
+    "cniDir": %q,
+    "binDir": %q,
+    %s
     "delegates": [{
         "name": "weave1",
         "cniVersion": "0.2.0",
@@ -180,17 +218,33 @@ var _ = Describe("multus operations", func() {
         "name": "other1",
         "cniVersion": "0.2.0",
         "type": "other-plugin"
+    },{
+        "name": "third1",
+        "cniVersion": "0.2.0",
+        "type": "third-plugin"
     }]
-}`),
-		}
+}`, filepath.Join(tmpDir, "cni"), binDir, extra))
+	}
 
-		fExec := &fakeExec{}
-		expectedResult1 := &types020.Result{
+	newResult := func(ip string) *types020.Result {
+		return &types020.Result{
 			CNIVersion: "0.2.0",
 			IP4: &types020.IPConfig{
-				IP: *testhelpers.EnsureCIDR("1.1.1.2/24"),
+				IP: *testhelpers.EnsureCIDR(ip),
 			},
 		}
+	}
+
+	It("executes delegates", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData:   delegatesConf(`"defaultDelegates": "weave1,other1",`),
+		}
+
+		fExec := &fakeExec{}
+		expectedResult1 := newResult("1.1.1.2/24")
 		expectedConf1 := `{
     "name": "weave1",
     "cniVersion": "0.2.0",
@@ -198,18 +252,12 @@ var _ = Describe("multus operations", func() {
 }`
 		fExec.addPlugin(nil, "eth0", expectedConf1, expectedResult1, nil)
 
-		expectedResult2 := &types020.Result{
-			CNIVersion: "0.2.0",
-			IP4: &types020.IPConfig{
-				IP: *testhelpers.EnsureCIDR("1.1.1.5/24"),
-			},
-		}
 		expectedConf2 := `{
     "name": "other1",
     "cniVersion": "0.2.0",
     "type": "other-plugin"
 }`
-		fExec.addPlugin(nil, "net1", expectedConf2, expectedResult2, nil)
+		fExec.addPlugin(nil, "eth1", expectedConf2, newResult("1.1.1.5/24"), nil)
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
@@ -224,84 +272,46 @@ var _ = Describe("multus operations", func() {
 		os.Setenv("CNI_IFNAME", "eth0")
 		err = cmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
+		Expect(fakePluginLog(binDir)).To(Equal([]string{"DEL eth1 other-plugin", "DEL eth0 weave-net"}))
 	})
 
 	It("executes delegates and kubernetes networks", func() {
-		fakePod := testhelpers.NewFakePod("testpod", "net1,net2")
-		net1 := `{
-	"name": "net1",
-	"type": "mynet",
-	"cniVersion": "0.2.0"
-}`
-		net2 := `{
-	"name": "net2",
-	"type": "mynet2",
-	"cniVersion": "0.2.0"
-}`
-		net3 := `{
-	"name": "net3",
-	"type": "mynet3",
-	"cniVersion": "0.2.0"
-}`
-		fmt.Println(net3)
+		fakePod := testhelpers.NewFakePod("testpod", "other1,third1")
+		// the events reuse the UID of the pod
+		fakePod.UID = "testpod-uid"
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
-			StdinData: []byte(`{
-    "name": "node-cni-network",
-    "type": "multus",
-    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
-    "delegates": [{
-        "name": "weave1",
-        "cniVersion": "0.2.0",
-        "type": "weave-net"
-    }]
-}`),
+			StdinData: delegatesConf(`"kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+    "defaultDelegates": "weave1",`),
 		}
 
 		fExec := &fakeExec{}
-		expectedResult1 := &types020.Result{
-			CNIVersion: "0.2.0",
-			IP4: &types020.IPConfig{
-				IP: *testhelpers.EnsureCIDR("1.1.1.2/24"),
-			},
-		}
-		expectedConf1 := `{
-    "name": "weave1",
+		// the networks of the pod replace the default delegates, weave1
+		// is not added
+		expectedResult1 := newResult("1.1.1.3/24")
+		fExec.addPlugin(nil, "eth0", `{
+    "name": "other1",
     "cniVersion": "0.2.0",
-    "type": "weave-net"
-}`
-		fExec.addPlugin(nil, "eth0", expectedConf1, expectedResult1, nil)
-		fExec.addPlugin(nil, "net1", net1, &types020.Result{
-			CNIVersion: "0.2.0",
-			IP4: &types020.IPConfig{
-				IP: *testhelpers.EnsureCIDR("1.1.1.3/24"),
-			},
-		}, nil)
-		fExec.addPlugin(nil, "net2", net2, &types020.Result{
-			CNIVersion: "0.2.0",
-			IP4: &types020.IPConfig{
-				IP: *testhelpers.EnsureCIDR("1.1.1.4/24"),
-			},
-		}, nil)
+    "type": "other-plugin"
+}`, expectedResult1, nil)
+		fExec.addPlugin(nil, "eth1", `{
+    "name": "third1",
+    "cniVersion": "0.2.0",
+    "type": "third-plugin"
+}`, newResult("1.1.1.4/24"), nil)
 
 		fKubeClient := testhelpers.NewFakeKubeClient()
 		fKubeClient.AddPod(fakePod)
-		//fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", net1)
-		//fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net2", net2)
-		// net3 is not used; make sure it's not accessed
-		//fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net3", net3)
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
 		result, err := cmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
-		Expect(fKubeClient.PodCount).To(Equal(2))
-		Expect(fKubeClient.NetCount).To(Equal(2))
+		Expect(fKubeClient.PodCount).To(Equal(1))
 		r := result.(*types020.Result)
 		// plugin 1 is the masterplugin
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
@@ -312,12 +322,14 @@ var _ = Describe("multus operations", func() {
 			ContainerID: "123456789",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
-			StdinData: []byte(`{
+			StdinData: []byte(fmt.Sprintf(`{
     "name": "node-cni-network",
     "type": "multus",
+    "cniDir": %q,
+    "defaultDelegates": "mynet-conflist",
     "delegates": [{
         "cniVersion": "0.3.1",
-        "name": "mynet-confList",
+        "name": "mynet-conflist",
 		"plugins": [
 			{
 				"type": "firstPlugin",
@@ -330,13 +342,13 @@ var _ = Describe("multus operations", func() {
             {"hostPort": 8080, "containerPort": 80, "protocol": "tcp"}
 		]
     }
-}`),
+}`, filepath.Join(tmpDir, "cni"))),
 		}
 
 		fExec := &fakeExec{}
 		expectedConf1 := `{
     "capabilities": {"portMappings": true},
-	"name": "mynet-confList",
+	"name": "mynet-conflist",
     "cniVersion": "0.3.1",
     "type": "firstPlugin",
     "runtimeConfig": {
@@ -345,10 +357,404 @@ var _ = Describe("multus operations", func() {
 		]
     }
 }`
-		fExec.addPlugin(nil, "eth0", expectedConf1, nil, nil)
+		fExec.addPlugin(nil, "eth0", expectedConf1, &current.Result{CNIVersion: "0.3.1"}, nil)
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
 		_, err := cmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 	})
+
+	It("tears down the delegates an interrupted ADD started", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData:   delegatesConf(`"defaultDelegates": "weave1,other1,third1",`),
+		}
+		store, err := backend.NewCNIStore(types.StoreFile, filepath.Join(tmpDir, "cni"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// multus crashes while other1 is added
+		var crashed []byte
+		fExec := &fakeExec{}
+		fExec.addPlugin(nil, "eth0", "", newResult("1.1.1.2/24"), nil)
+		fExec.addPlugin(nil, "eth1", "", newResult("1.1.1.3/24"), nil).hook = func() {
+			entry, err := backend.LoadEntry(store, args.ContainerID)
+			Expect(err).NotTo(HaveOccurred())
+			var states []string
+			for _, delegate := range entry.Delegates {
+				states = append(states, delegate.Progress())
+			}
+			Expect(states).To(Equal([]string{types.DelegateStateDone, types.DelegateStateInProgress, types.DelegateStatePending}))
+			crashed, err = store.Load(args.ContainerID)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		fExec.addPlugin(nil, "eth2", "", newResult("1.1.1.4/24"), nil)
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err = cmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		entry, err := backend.LoadEntry(store, args.ContainerID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Interrupted()).To(BeFalse())
+		Expect(store.Save(args.ContainerID, crashed)).To(Succeed())
+
+		// third1 was never started
+		os.Setenv("CNI_COMMAND", "DEL")
+		Expect(cmdDel(args, fExec, nil)).To(Succeed())
+		Expect(fakePluginLog(binDir)).To(Equal([]string{"DEL eth1 other-plugin", "DEL eth0 weave-net"}))
+		_, err = store.Load(args.ContainerID)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("recovers the delegates of a DEL without an entry", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData:   delegatesConf(`"defaultDelegates": "weave1,other1",`),
+		}
+		os.Setenv("CNI_COMMAND", "DEL")
+		Expect(cmdDel(args, &fakeExec{}, nil)).To(Succeed())
+		Expect(fakePluginLog(binDir)).To(BeEmpty())
+
+		args.StdinData = delegatesConf(`"defaultDelegates": "weave1,other1", "recoverDel": true,`)
+		Expect(cmdDel(args, &fakeExec{}, nil)).To(Succeed())
+		// with the ifnames of the ADD
+		Expect(fakePluginLog(binDir)).To(Equal([]string{"DEL eth1 other-plugin", "DEL eth0 weave-net"}))
+	})
+})
+
+var _ = Describe("multus chained mode", func() {
+	It("assigns secondary ifnames only", func() {
+		delegates := []*types.DelegateNetConf{
+			{Conf: cnitypes.NetConf{Name: "net1"}, MasterPlugin: true},
+			{Conf: cnitypes.NetConf{Name: "net2"}, IfnameRequest: "north"},
+		}
+		Expect(setDelegatesIfname(delegates, "eth0", true)).To(Succeed())
+		Expect(delegates[0].IfnameRequest).To(Equal("eth1"))
+		Expect(delegates[0].MasterPlugin).To(BeFalse())
+		Expect(delegates[1].IfnameRequest).To(Equal("north"))
+		Expect(delegates[1].MasterPlugin).To(BeFalse())
+
+		delegates = []*types.DelegateNetConf{
+			{Conf: cnitypes.NetConf{Name: "net1"}, IfnameRequest: "eth0"},
+		}
+		Expect(setDelegatesIfname(delegates, "eth0", true)).NotTo(Succeed())
+	})
+
+	It("merges secondary results into the prevResult", func() {
+		prevResult := &current.Result{
+			CNIVersion: "0.3.1",
+			Interfaces: []*current.Interface{
+				{Name: "cni0"},
+				{Name: "eth0", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{
+				{Version: "4", Interface: current.Int(1), Address: *testhelpers.EnsureCIDR("10.0.0.5/24")},
+			},
+			Routes: []*cnitypes.Route{{Dst: *testhelpers.EnsureCIDR("0.0.0.0/0")}},
+		}
+		secondary := &current.Result{
+			CNIVersion: "0.3.1",
+			Interfaces: []*current.Interface{
+				{Name: "eth1", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{
+				{Version: "4", Interface: current.Int(0), Address: *testhelpers.EnsureCIDR("192.168.0.5/24")},
+			},
+			Routes: []*cnitypes.Route{{Dst: *testhelpers.EnsureCIDR("192.168.1.0/24")}},
+		}
+
+		result, err := mergeResult(prevResult, secondary)
+		Expect(err).NotTo(HaveOccurred())
+		r := result.(*current.Result)
+		Expect(r.Interfaces).To(HaveLen(3))
+		Expect(r.IPs).To(HaveLen(2))
+		Expect(*r.IPs[1].Interface).To(Equal(2))
+		Expect(r.Interfaces[*r.IPs[1].Interface].Name).To(Equal("eth1"))
+		Expect(r.Routes).To(HaveLen(1))
+		// the secondary result itself is left untouched
+		Expect(*secondary.IPs[0].Interface).To(Equal(0))
+	})
+})
+
+var _ = Describe("multus network status", func() {
+	It("marks the delegates attempted by a failed ADD", func() {
+		delegates := []*types.DelegateNetConf{
+			{Conf: cnitypes.NetConf{Name: "net1"}, IfnameRequest: "eth0", MasterPlugin: true},
+			{Conf: cnitypes.NetConf{Name: "net2"}, IfnameRequest: "eth1"},
+			{Conf: cnitypes.NetConf{Name: "net3"}, IfnameRequest: "eth2"},
+		}
+		delegatesNetStatus := [][]*types.NetworkStatus{
+			{{Name: "net1", Interface: "eth0", IPs: []string{"10.0.0.5"}, Default: true, State: types.NetworkStateOK}},
+			{{Name: "net2", Interface: "eth1", IPs: []string{"10.1.0.5"}, State: types.NetworkStateOK}},
+		}
+		addErr := fmt.Errorf("%s", strings.Repeat("x", 1024))
+		delErr := fmt.Errorf("failed to delete net2")
+
+		netStatus := getFailedNetworkStatus(delegates, delegatesNetStatus, delegates[1:2], addErr, delErr)
+		Expect(netStatus).To(HaveLen(3))
+		Expect(netStatus[0].Name).To(Equal("net1"))
+		Expect(netStatus[0].State).To(Equal(types.NetworkStateRolledBack))
+		Expect(netStatus[0].IPs).To(BeEmpty())
+		Expect(netStatus[0].Default).To(BeTrue())
+		Expect(netStatus[1].Name).To(Equal("net2"))
+		Expect(netStatus[1].State).To(Equal(types.NetworkStateOK))
+		Expect(netStatus[1].IPs).To(Equal([]string{"10.1.0.5"}))
+		Expect(netStatus[1].Error).To(Equal("failed to delete net2"))
+		Expect(netStatus[2].Name).To(Equal("net3"))
+		Expect(netStatus[2].Interface).To(Equal("eth2"))
+		Expect(netStatus[2].State).To(Equal(types.NetworkStateFailed))
+		Expect(netStatus[2].Error).To(HaveLen(maxStatusErrorLen))
+	})
+})
+
+var _ = Describe("multus gc", func() {
+	It("reads the live containers", func() {
+		live, err := readContainerIDs(strings.NewReader("container1\n\n  container2 \n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(live).To(Equal(map[string]bool{"container1": true, "container2": true}))
+	})
+
+	It("finds the stale entries", func() {
+		tmpDir, err := ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		netns := filepath.Join(tmpDir, "ns1")
+		Expect(ioutil.WriteFile(netns, nil, 0644)).To(Succeed())
+
+		now := time.Now()
+		old := now.Add(-time.Hour)
+		live := map[string]bool{"container1": true}
+		Expect(staleReason("container1", &types.CacheEntry{CreatedAt: old}, live, time.Minute, now)).To(BeEmpty())
+		Expect(staleReason("container2", &types.CacheEntry{CreatedAt: old}, live, time.Minute, now)).To(Equal("container is not alive"))
+		// the ADD may be in progress
+		Expect(staleReason("container2", &types.CacheEntry{CreatedAt: now}, live, time.Minute, now)).To(BeEmpty())
+
+		Expect(staleReason("container1", &types.CacheEntry{CreatedAt: old, Netns: netns}, nil, time.Minute, now)).To(BeEmpty())
+		Expect(staleReason("container1", &types.CacheEntry{CreatedAt: old, Netns: filepath.Join(tmpDir, "ns2")}, nil, time.Minute, now)).To(ContainSubstring("does not exist"))
+		// unknown netns
+		Expect(staleReason("container1", &types.CacheEntry{}, nil, time.Minute, now)).To(BeEmpty())
+
+		interrupted := &types.CacheEntry{CreatedAt: old, Delegates: []*types.CacheDelegate{{State: types.DelegateStateInProgress}}}
+		Expect(staleReason("container1", interrupted, live, time.Minute, now)).To(Equal("ADD was interrupted"))
+		interrupted.CreatedAt = now
+		Expect(staleReason("container1", interrupted, live, time.Minute, now)).To(BeEmpty())
+	})
+
+	It("passes the recorded pod to the DEL", func() {
+		entry := &types.CacheEntry{
+			PodNamespace: "default",
+			PodName:      "pod1",
+			PodUID:       "uid1",
+			Netns:        "/proc/1234/ns/net",
+			Delegates:    []*types.CacheDelegate{{IfName: "eth0"}},
+		}
+		args := gcArgs("container1", entry, []byte("{}"))
+		Expect(args.Netns).To(Equal("/proc/1234/ns/net"))
+		Expect(args.IfName).To(Equal("eth0"))
+		k8sArgs := &types.K8sArgs{}
+		Expect(cnitypes.LoadArgs(args.Args, k8sArgs)).To(Succeed())
+		Expect(string(k8sArgs.K8S_POD_NAME)).To(Equal("pod1"))
+		Expect(string(k8sArgs.K8S_POD_UID)).To(Equal("uid1"))
+		Expect(string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID)).To(Equal("container1"))
+	})
+})
+
+var _ = Describe("multus ls", func() {
+	It("describes the networks of the entry", func() {
+		entry := &types.CacheEntry{
+			Delegates: []*types.CacheDelegate{
+				{IfName: "eth0", Conf: &types.DelegateNetConf{Conf: cnitypes.NetConf{Name: "net1"}}},
+				{IfName: "eth1", Conf: &types.DelegateNetConf{ConfList: cnitypes.NetConfList{Name: "net2"}, ConfListPlugin: true}},
+			},
+		}
+		Expect(entryNetworks(entry)).To(Equal([]string{"net1@eth0", "net2@eth1"}))
+		Expect(entryHasNetwork(entry, "net2")).To(BeTrue())
+		Expect(entryHasNetwork(entry, "net3")).To(BeFalse())
+	})
+})
+
+var _ = Describe("multus re-ADD", func() {
+	It("compares the planned and stored delegates", func() {
+		net1 := &types.DelegateNetConf{Conf: cnitypes.NetConf{Name: "net1"}, IfnameRequest: "eth0", Bytes: []byte(`{"name":"net1","type":"bridge"}`)}
+		net2 := &types.DelegateNetConf{Conf: cnitypes.NetConf{Name: "net2"}, IfnameRequest: "eth1", Bytes: []byte(`{"name":"net2","type":"macvlan"}`)}
+		args := &skel.CmdArgs{ContainerID: "container1", Netns: "/var/run/netns/ns1", StdinData: []byte("{}")}
+		entry := newCacheEntry(args, &types.K8sArgs{}, "uid1", []*types.DelegateNetConf{net1, net2})
+		Expect(entry.Netns).To(Equal("/var/run/netns/ns1"))
+		Expect(sameDelegates([]*types.DelegateNetConf{net1, net2}, entry)).To(BeTrue())
+		Expect(sameDelegates([]*types.DelegateNetConf{net1}, entry)).To(BeFalse())
+
+		moved := *net2
+		moved.IfnameRequest = "eth2"
+		Expect(sameDelegates([]*types.DelegateNetConf{net1, &moved}, entry)).To(BeFalse())
+		changed := *net2
+		changed.Bytes = []byte(`{"name":"net2","type":"ipvlan"}`)
+		Expect(sameDelegates([]*types.DelegateNetConf{net1, &changed}, entry)).To(BeFalse())
+	})
+
+	It("digests the conf without the per-invocation fields", func() {
+		conf := []byte(`{"name":"multus-cni","type":"multus","delegates":[{"type":"bridge"}]}`)
+		invoked := []byte(`{"type":"multus","name":"multus-cni","delegates":[{"type":"bridge"}],"runtimeConfig":{"portMappings":[]},"prevResult":{"cniVersion":"0.3.1"},"args":{"cni":{}}}`)
+		Expect(confDigest(invoked)).To(Equal(confDigest(conf)))
+		Expect(confDigest([]byte(`{"name":"multus-cni","type":"multus","delegates":[{"type":"macvlan"}]}`))).NotTo(Equal(confDigest(conf)))
+	})
+
+	It("does not reuse the delegates of an unfinished ADD", func() {
+		net1 := &types.DelegateNetConf{Conf: cnitypes.NetConf{CNIVersion: "0.4.0", Name: "net1"}, IfnameRequest: "eth0", Bytes: []byte(`{"cniVersion":"0.4.0","name":"net1","type":"bridge"}`)}
+		args := &skel.CmdArgs{ContainerID: "container1", Netns: "/var/run/netns/ns1"}
+		entry := newCacheEntry(args, &types.K8sArgs{}, "", []*types.DelegateNetConf{net1})
+		_, err := checkDelegates(&fakeExec{}, args, &types.K8sArgs{}, entry, nil, "/opt/cni/bin")
+		Expect(err).To(MatchError(ContainSubstring("no result of network net1")))
+	})
+
+	It("follows the progress of an interrupted ADD", func() {
+		net1 := &types.DelegateNetConf{Conf: cnitypes.NetConf{CNIVersion: "0.4.0", Name: "net1", Type: "bridge"}, IfnameRequest: "eth0", Bytes: []byte(`{"cniVersion":"0.4.0","name":"net1","type":"bridge"}`)}
+		net2 := &types.DelegateNetConf{Conf: cnitypes.NetConf{Name: "net2", Type: "macvlan"}, IfnameRequest: "eth1", Bytes: []byte(`{"cniVersion":"0.3.1","name":"net2","type":"macvlan"}`)}
+		net3 := &types.DelegateNetConf{Conf: cnitypes.NetConf{Name: "net3", Type: "ipvlan"}, IfnameRequest: "eth2", Bytes: []byte(`{"cniVersion":"0.3.1","name":"net3","type":"ipvlan"}`)}
+		args := &skel.CmdArgs{ContainerID: "container1", Netns: "/var/run/netns/ns1", IfName: "eth0"}
+		entry := newCacheEntry(args, &types.K8sArgs{}, "", []*types.DelegateNetConf{net1, net2, net3})
+		entry.Delegates[0].State = types.DelegateStateDone
+		entry.Delegates[1].State = types.DelegateStateInProgress
+		entry.Delegates[2].State = types.DelegateStatePending
+		Expect(entry.Interrupted()).To(BeTrue())
+
+		// only the finished delegate is checked, net1 has no result
+		_, err := checkDelegates(&fakeExec{}, args, &types.K8sArgs{}, entry, nil, "/opt/cni/bin")
+		Expect(err).To(MatchError(ContainSubstring("no result of network net1")))
+		entry.Delegates[0].State = types.DelegateStatePending
+		results, err := checkDelegates(&fakeExec{}, args, &types.K8sArgs{}, entry, nil, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(BeEmpty())
+		entry.Delegates[0].State = types.DelegateStateDone
+
+		// the pending delegates were never started
+		n := &types.NetConf{BinDir: "/opt/cni/bin"}
+		Expect(undoUnfinished(&fakeExec{}, args, &types.K8sArgs{}, n, entry, 2)).To(Succeed())
+
+		entry.DropPending()
+		Expect(entry.DelegateConfs()).To(Equal([]*types.DelegateNetConf{net1, net2}))
+	})
+})
+
+// writeFakePlugins writes the plugins into binDir, they log their command to
+// binDir/log. Unlike ADD and GET, the DEL of a delegate runs the plugin file
+// instead of the fake exec.
+func writeFakePlugins(binDir string, pluginTypes ...string) {
+	Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+	for _, pluginType := range pluginTypes {
+		script := fmt.Sprintf("#!/bin/sh\necho \"$CNI_COMMAND $CNI_IFNAME %s\" >> %s\n", pluginType, filepath.Join(binDir, "log"))
+		Expect(ioutil.WriteFile(filepath.Join(binDir, pluginType), []byte(script), 0755)).To(Succeed())
+	}
+}
+
+// removeCachedResults removes the ADD results libcni caches outside of the
+// cniDir for the container
+func removeCachedResults(containerID string) {
+	results, err := filepath.Glob(filepath.Join("/var/lib/cni/results", "*-"+containerID))
+	Expect(err).NotTo(HaveOccurred())
+	for _, result := range results {
+		Expect(os.Remove(result)).To(Succeed())
+	}
+}
+
+// fakePluginLog returns the commands run by the plugins of writeFakePlugins
+func fakePluginLog(binDir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(binDir, "log"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	Expect(err).NotTo(HaveOccurred())
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+var _ = Describe("multus repeated ADD", func() {
+	var testNS ns.NetNS
+	var tmpDir string
+	var binDir string
+	var args *skel.CmdArgs
+
+	newArgs := func(cniVersion string) *skel.CmdArgs {
+		return &skel.CmdArgs{
+			ContainerID: "multus-readd",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData: []byte(fmt.Sprintf(`{
+    "name": "multus-cni",
+    "type": "multus",
+    "cniVersion": %q,
+    "cniDir": %q,
+    "binDir": %q,
+    "defaultDelegates": "net1",
+    "delegates": [
+        {"name": "net1", "type": "bridge", "cniVersion": %q}
+    ]
+}`, cniVersion, filepath.Join(tmpDir, "cni"), binDir, cniVersion)),
+		}
+	}
+
+	newResult := func(cniVersion string) *current.Result {
+		return &current.Result{
+			CNIVersion: cniVersion,
+			Interfaces: []*current.Interface{{Name: "eth0", Sandbox: testNS.Path()}},
+			IPs: []*current.IPConfig{
+				{Version: "4", Interface: current.Int(0), Address: *testhelpers.EnsureCIDR("10.0.0.5/24")},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		os.Setenv("CNI_NETNS", testNS.Path())
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		binDir = filepath.Join(tmpDir, "bin")
+		writeFakePlugins(binDir, "bridge")
+		os.Setenv("CNI_COMMAND", "ADD")
+	})
+
+	AfterEach(func() {
+		removeCachedResults(args.ContainerID)
+		Expect(testNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("reuses the delegates which pass the GET", func() {
+		args = newArgs("0.4.0")
+		fExec := &fakeExec{}
+		fExec.addPlugin(nil, "eth0", "", newResult("0.4.0"), nil)
+
+		result1, err := cmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		result2, err := cmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.addIndex).To(Equal(1))
+		Expect(fExec.getIndex).To(Equal(1))
+		Expect(fakePluginLog(binDir)).To(BeEmpty())
+
+		json1, err := json.Marshal(result1)
+		Expect(err).NotTo(HaveOccurred())
+		json2, err := json.Marshal(result2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(json2).To(MatchJSON(json1))
+	})
+
+	It("adds the delegates older than 0.4.0 again", func() {
+		args = newArgs("0.3.1")
+		fExec := &fakeExec{}
+		fExec.addPlugin(nil, "eth0", "", newResult("0.3.1"), nil)
+		fExec.addPlugin(nil, "eth0", "", newResult("0.3.1"), nil)
+
+		_, err := cmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = cmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.getIndex).To(Equal(0))
+		Expect(fakePluginLog(binDir)).To(Equal([]string{"DEL eth0 bridge"}))
+		Expect(fExec.addIndex).To(Equal(2))
+	})
 })
@@ -15,20 +15,36 @@
 package backend
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const LineBreak = "\r\n"
 
 var defaultDataDir = "/var/lib/cni/networks/multus"
 
+const (
+	// temp files of Save are hidden and never loaded as entries
+	tmpPrefix     = ".tmp-"
+	quarantineDir = ".quarantine"
+)
+
+// ErrCorruptEntry is returned by Load and LoadEntry for an entry which can't be
+// parsed, the entry is quarantined and the container is unknown to the store
+// afterwards
+var ErrCorruptEntry = errors.New("corrupt store entry")
+
 // Store is a simple disk-backed store that creates one file per IP
 // address in a given directory. The contents of the file are the container ID.
 type Store struct {
+	locker
 	dataDir string
 }
 
@@ -36,22 +52,44 @@ func NewStore(dataDir string) (*Store, error) {
 	if dataDir == "" {
 		dataDir = defaultDataDir
 	}
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dataDir, lockDir), 0755); err != nil {
 		return nil, err
 	}
 
-	// TODO need add lock?
-	return &Store{dataDir}, nil
+	return &Store{
+		locker:  newLocker(dataDir),
+		dataDir: dataDir,
+	}, nil
+}
+
+// Lock takes the lock of the container, the ADD or DEL holds it until its
+// entry is saved or removed and all delegates are called
+func (s *Store) Lock(id string) error {
+	return s.lock(id)
+}
+
+// Unlock releases the lock of the container, the lock file is removed if the
+// caller removed the entry of the container
+func (s *Store) Unlock(id string, removed bool) error {
+	return s.unlock(id, removed)
 }
 
+// Save writes the entry through a synced temp file renamed into place, so a
+// crash leaves either the old or the new entry, never a partial one
 func (s *Store) Save(id string, data []byte) error {
 	fname := GetEscapedPath(s.dataDir, id)
 
-	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	f, err := ioutil.TempFile(s.dataDir, tmpPrefix+filepath.Base(fname))
 	if err != nil {
 		return err
 	}
-	if _, err = f.Write(data); err != nil {
+	// the entries are readable like the files ioutil.WriteFile wrote before
+	if err = f.Chmod(0644); err == nil {
+		if _, err = f.Write(data); err == nil {
+			err = f.Sync()
+		}
+	}
+	if err != nil {
 		f.Close()
 		os.Remove(f.Name())
 		return err
@@ -60,22 +98,117 @@ func (s *Store) Save(id string, data []byte) error {
 		os.Remove(f.Name())
 		return err
 	}
-	return nil
+	if err := os.Rename(f.Name(), fname); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(s.dataDir)
 }
 
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Load reads the entry. An entry which is not valid json, e.g. written by an
+// older multus which crashed mid-write, is moved to the quarantine dir and
+// ErrCorruptEntry is returned.
 func (s *Store) Load(id string) ([]byte, error) {
 	fname := GetEscapedPath(s.dataDir, id)
 	data, err := ioutil.ReadFile(fname)
 	if err != nil {
 		return nil, err
 	}
+	if !json.Valid(data) {
+		if err := s.quarantine(fname); err != nil {
+			return nil, fmt.Errorf("%v, and failed to quarantine it: %v", ErrCorruptEntry, err)
+		}
+		return nil, ErrCorruptEntry
+	}
 	return data, nil
 }
 
+// Quarantine moves the entry of the container into the quarantine dir
+func (s *Store) Quarantine(id string) error {
+	return s.quarantine(GetEscapedPath(s.dataDir, id))
+}
+
+// quarantine keeps the corrupt entry for inspection out of the way of
+// the next commands
+func (s *Store) quarantine(fname string) error {
+	dir := filepath.Join(s.dataDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	qname := fmt.Sprintf("%s.%d", filepath.Base(fname), time.Now().UnixNano())
+	return os.Rename(fname, filepath.Join(dir, qname))
+}
+
 func (s *Store) Remove(id string) error {
 	return os.Remove(GetEscapedPath(s.dataDir, id))
 }
 
+// List returns the IDs of the containers with an entry, the lock files,
+// temp files and quarantined entries are hidden
+func (s *Store) List() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		ids = append(ids, file.Name())
+	}
+	return ids, nil
+}
+
+// RemoveTempFiles removes the temp files of Save in dataDir older than
+// minAge, which a multus killed before renaming them left behind. It returns
+// the names of the files, with dryRun they are not removed.
+func RemoveTempFiles(dataDir string, minAge time.Duration, dryRun bool) ([]string, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !strings.HasPrefix(file.Name(), tmpPrefix) {
+			continue
+		}
+		if time.Since(file.ModTime()) < minAge {
+			// a Save in progress
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dataDir, file.Name())); err != nil && !os.IsNotExist(err) {
+				return names, err
+			}
+		}
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
+// Stat describes the entry of the container
+func (s *Store) Stat(id string) (*EntryInfo, error) {
+	fi, err := os.Stat(GetEscapedPath(s.dataDir, id))
+	if err != nil {
+		return nil, err
+	}
+	return &EntryInfo{ID: id, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
 func GetEscapedPath(dataDir string, fname string) string {
 	if runtime.GOOS == "windows" {
 		fname = strings.Replace(fname, ":", "_", -1)
@@ -0,0 +1,388 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
+func TestBackend(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "backend")
+}
+
+var _ = Describe("store", func() {
+	var tmpDir string
+	var store, other *Store
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = NewStore(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		// another multus process
+		other, err = NewStore(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		other.lockTimeout = 200 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("serializes the commands of the same container", func() {
+		Expect(store.Lock("container1")).To(Succeed())
+		Expect(store.Lock("container1")).NotTo(Succeed())
+
+		err := other.Lock("container1")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("timeout"))
+		Expect(other.Lock("container2")).To(Succeed())
+		Expect(other.Unlock("container2", false)).To(Succeed())
+
+		locked := make(chan error)
+		go func() {
+			other.lockTimeout = 5 * time.Second
+			locked <- other.Lock("container1")
+		}()
+		Consistently(locked, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(store.Save("container1", []byte(`["data"]`))).To(Succeed())
+		Expect(store.Unlock("container1", false)).To(Succeed())
+		Eventually(locked).Should(Receive(BeNil()))
+
+		data, err := other.Load("container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["data"]`))
+		Expect(other.Unlock("container1", false)).To(Succeed())
+		Expect(store.Unlock("container1", false)).NotTo(Succeed())
+	})
+
+	It("removes the lock file with the entry", func() {
+		lockPath := filepath.Join(tmpDir, lockDir, "container1")
+		Expect(store.Lock("container1")).To(Succeed())
+		Expect(store.Save("container1", []byte(`["data"]`))).To(Succeed())
+		Expect(store.Unlock("container1", false)).To(Succeed())
+		Expect(lockPath).To(BeAnExistingFile())
+
+		Expect(store.Lock("container1")).To(Succeed())
+		Expect(store.Remove("container1")).To(Succeed())
+		Expect(store.Unlock("container1", true)).To(Succeed())
+		Expect(lockPath).NotTo(BeAnExistingFile())
+
+		// a removed lock file is never locked by a waiter
+		Expect(other.Lock("container1")).To(Succeed())
+		Expect(other.Unlock("container1", false)).To(Succeed())
+	})
+
+	It("writes entries atomically", func() {
+		Expect(store.Save("container1", []byte(`["old"]`))).To(Succeed())
+		Expect(store.Save("container1", []byte(`["new"]`))).To(Succeed())
+		data, err := store.Load("container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["new"]`))
+
+		files, err := ioutil.ReadDir(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		Expect(names).To(ConsistOf(lockDir, "container1"))
+	})
+
+	It("lists the entries", func() {
+		Expect(store.Lock("container1")).To(Succeed())
+		Expect(store.Save("container1", []byte(`["data"]`))).To(Succeed())
+		Expect(store.Unlock("container1", false)).To(Succeed())
+		Expect(store.Save("container2", []byte(`["data"]`))).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, tmpPrefix+"container3"), []byte(`["da`), 0644)).To(Succeed())
+
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(ConsistOf("container1", "container2"))
+
+		info, err := store.Stat("container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.ID).To(Equal("container1"))
+		Expect(info.Size).To(Equal(int64(len(`["data"]`))))
+		Expect(info.ModTime).To(BeTemporally("~", time.Now(), time.Minute))
+		_, err = store.Stat("container3")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("saves readable entries and removes abandoned temp files", func() {
+		Expect(store.Save("container1", []byte(`["data"]`))).To(Succeed())
+		fi, err := os.Stat(filepath.Join(tmpDir, "container1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0644)))
+
+		oldTemp := filepath.Join(tmpDir, tmpPrefix+"container2123")
+		newTemp := filepath.Join(tmpDir, tmpPrefix+"container3456")
+		Expect(ioutil.WriteFile(oldTemp, []byte(`["da`), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(newTemp, []byte(`["da`), 0644)).To(Succeed())
+		old := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(oldTemp, old, old)).To(Succeed())
+
+		names, err := RemoveTempFiles(tmpDir, time.Minute, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(Equal([]string{tmpPrefix + "container2123"}))
+		Expect(oldTemp).To(BeAnExistingFile())
+
+		names, err = RemoveTempFiles(tmpDir, time.Minute, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(Equal([]string{tmpPrefix + "container2123"}))
+		Expect(oldTemp).NotTo(BeAnExistingFile())
+		Expect(newTemp).To(BeAnExistingFile())
+	})
+
+	It("quarantines corrupt entries", func() {
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "container1"), []byte(`[{"Conf": {"name": "net`), 0644)).To(Succeed())
+		_, err := store.Load("container1")
+		Expect(err).To(Equal(ErrCorruptEntry))
+
+		_, err = store.Load("container1")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		files, err := ioutil.ReadDir(filepath.Join(tmpDir, quarantineDir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("cache entry", func() {
+	var tmpDir string
+	var store *Store
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = NewStore(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("saves and loads the versioned entry", func() {
+		entry := &types.CacheEntry{
+			CreatedAt:    time.Now(),
+			PodNamespace: "default",
+			PodName:      "pod1",
+			PodUID:       "uid1",
+			Netns:        "/var/run/netns/ns1",
+			ConfDigest:   "abcd",
+			Delegates: []*types.CacheDelegate{{
+				IfName: "eth0",
+				Result: []byte(`{"cniVersion":"0.3.1","ips":[{"version":"4","address":"10.0.0.2/24"}]}`),
+				Conf:   &types.DelegateNetConf{IfnameRequest: "eth0", Bytes: []byte(`{"name":"net1","type":"bridge"}`)},
+			}},
+		}
+		Expect(SaveEntry(store, "container1", entry)).To(Succeed())
+
+		loaded, err := LoadEntry(store, "container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.Version).To(Equal(types.CacheVersion))
+		Expect(loaded.PodUID).To(Equal("uid1"))
+		Expect(loaded.Netns).To(Equal("/var/run/netns/ns1"))
+		Expect(loaded.ConfDigest).To(Equal("abcd"))
+		Expect(loaded.Delegates).To(HaveLen(1))
+		Expect(loaded.Delegates[0].IfName).To(Equal("eth0"))
+		Expect(loaded.Delegates[0].Result).To(MatchJSON(entry.Delegates[0].Result))
+		Expect(loaded.DelegateConfs()[0].Bytes).To(MatchJSON(`{"name":"net1","type":"bridge"}`))
+	})
+
+	It("loads the bare delegates array of older multus", func() {
+		Expect(store.Save("container1", []byte(`[{"Conf":{"name":"net1","type":"bridge"},"ifnameRequest":"eth1","Bytes":"eyJuYW1lIjoibmV0MSJ9","podUID":"uid1"}]`))).To(Succeed())
+
+		entry, err := LoadEntry(store, "container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Version).To(Equal(0))
+		Expect(entry.PodUID).To(Equal("uid1"))
+		Expect(entry.Delegates).To(HaveLen(1))
+		Expect(entry.Delegates[0].IfName).To(Equal("eth1"))
+		Expect(entry.Delegates[0].Conf.Conf.Name).To(Equal("net1"))
+	})
+
+	It("quarantines entries which can't be decoded", func() {
+		Expect(store.Save("container1", []byte(`{"version":99,"delegates":[]}`))).To(Succeed())
+		Expect(store.Save("container2", []byte(`{"delegates":{"name":"net1"}}`))).To(Succeed())
+		Expect(store.Save("container3", []byte(`[{"Conf":"net1"}]`))).To(Succeed())
+
+		for _, id := range []string{"container1", "container2", "container3"} {
+			_, err := LoadEntry(store, id)
+			Expect(err).To(Equal(ErrCorruptEntry))
+			_, err = LoadEntry(store, id)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		}
+		files, err := ioutil.ReadDir(filepath.Join(tmpDir, quarantineDir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(3))
+	})
+})
+
+var _ = Describe("bolt store", func() {
+	var tmpDir string
+	var store *BoltStore
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = NewBoltStore(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("saves, loads and removes entries", func() {
+		_, err := store.Load("container1")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(store.Lock("container1")).To(Succeed())
+		Expect(store.Save("container1", []byte(`["old"]`))).To(Succeed())
+		Expect(store.Save("container1", []byte(`["new"]`))).To(Succeed())
+		Expect(store.Unlock("container1", false)).To(Succeed())
+		data, err := store.Load("container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["new"]`))
+
+		// the lock file goes with the entry
+		lockPath := filepath.Join(tmpDir, lockDir, "container1")
+		Expect(lockPath).To(BeAnExistingFile())
+		Expect(store.Lock("container1")).To(Succeed())
+		Expect(store.Remove("container1")).To(Succeed())
+		Expect(store.Unlock("container1", true)).To(Succeed())
+		Expect(lockPath).NotTo(BeAnExistingFile())
+
+		err = store.Remove("container1")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("lists the entries by prefix", func() {
+		for _, id := range []string{"abc1", "abd2", "abc3"} {
+			Expect(store.Save(id, []byte(`["data"]`))).To(Succeed())
+		}
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"abc1", "abc3", "abd2"}))
+		ids, err = store.ListPrefix("abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"abc1", "abc3"}))
+
+		info, err := store.Stat("abd2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size).To(Equal(int64(len(`["data"]`))))
+		_, err = store.Stat("abd")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("compacts the database", func() {
+		data := []byte(`["` + strings.Repeat("x", 64*1024) + `"]`)
+		for i := 0; i < 64; i++ {
+			Expect(store.Save(fmt.Sprintf("container%d", i), data)).To(Succeed())
+		}
+		for i := 1; i < 64; i++ {
+			Expect(store.Remove(fmt.Sprintf("container%d", i))).To(Succeed())
+		}
+		before, err := os.Stat(store.dbPath())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.Compact()).To(Succeed())
+		after, err := os.Stat(store.dbPath())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after.Size()).To(BeNumerically("<", before.Size()))
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"container0"}))
+	})
+
+	It("quarantines entries which can't be decoded", func() {
+		Expect(store.Save("container1", []byte(`{"version":99,"delegates":[]}`))).To(Succeed())
+		_, err := LoadEntry(store, "container1")
+		Expect(err).To(Equal(ErrCorruptEntry))
+		_, err = LoadEntry(store, "container1")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Expect(os.IsNotExist(store.Quarantine("container1"))).To(BeTrue())
+
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(BeEmpty())
+	})
+
+	It("imports the entries of the file store", func() {
+		files, err := NewStore(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files.Save("container1", []byte(`["file1"]`))).To(Succeed())
+		Expect(files.Save("container2", []byte(`["file2"]`))).To(Succeed())
+		Expect(store.Save("container2", []byte(`["bolt2"]`))).To(Succeed())
+		// an ADD in progress
+		Expect(files.Save("container3", []byte(`["file3"]`))).To(Succeed())
+		Expect(files.Lock("container3")).To(Succeed())
+
+		cniStore, err := NewCNIStore(types.StoreBolt, tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		ids, err := files.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"container3"}))
+
+		data, err := cniStore.Load("container1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["file1"]`))
+		data, err = cniStore.Load("container2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["bolt2"]`))
+
+		Expect(filepath.Join(tmpDir, importedFile)).NotTo(BeAnExistingFile())
+
+		Expect(files.Unlock("container3", false)).To(Succeed())
+		_, err = NewCNIStore(types.StoreBolt, tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		ids, err = cniStore.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"container1", "container2", "container3"}))
+		Expect(filepath.Join(tmpDir, importedFile)).To(BeAnExistingFile())
+
+		// the import is done once
+		Expect(files.Save("container4", []byte(`["file4"]`))).To(Succeed())
+		_, err = NewCNIStore(types.StoreBolt, tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = cniStore.Load("container4")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// until the node uses the file store again
+		_, err = NewCNIStore(types.StoreFile, tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = NewCNIStore(types.StoreBolt, tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		data, err = cniStore.Load("container4")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`["file4"]`))
+	})
+})
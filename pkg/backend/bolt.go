@@ -0,0 +1,323 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// the database in dataDir and its lock in the lock dir, hidden from the
+	// file store
+	boltFile = ".multus.db"
+
+	entriesBucket    = "entries"
+	quarantineBucket = "quarantine"
+)
+
+// BoltStore keeps the entries in a single bbolt database in dataDir, every
+// Save, Load and Remove is a transaction of its own. The database is opened
+// per operation so the multus processes only hold it briefly, the containers
+// are locked like in the file store and both stores share the lock files.
+type BoltStore struct {
+	locker
+	dataDir string
+}
+
+// NewBoltStore returns the store of the database in dataDir, the database
+// file is created when the store is first used
+func NewBoltStore(dataDir string) (*BoltStore, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, lockDir), 0755); err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{
+		locker:  newLocker(dataDir),
+		dataDir: dataDir,
+	}, nil
+}
+
+func (s *BoltStore) dbPath() string {
+	return filepath.Join(s.dataDir, boltFile)
+}
+
+// withDB opens the database for fn. The database lock is taken before bbolt
+// opens the file, Compact replaces the file under the same lock.
+func (s *BoltStore) withDB(fn func(db *bolt.DB) error) error {
+	l, err := lockFile(s.lockPath(boltFile), s.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock(false)
+
+	db, err := bolt.Open(s.dbPath(), 0600, &bolt.Options{Timeout: s.lockTimeout})
+	if err != nil {
+		return err
+	}
+	err = fn(db)
+	if err1 := db.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (s *BoltStore) update(fn func(b *bolt.Bucket) error) error {
+	return s.withDB(func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(entriesBucket))
+			if err != nil {
+				return err
+			}
+			return fn(b)
+		})
+	})
+}
+
+// view runs fn with the entries bucket, which is nil before the first Save
+func (s *BoltStore) view(fn func(b *bolt.Bucket) error) error {
+	return s.withDB(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return fn(tx.Bucket([]byte(entriesBucket)))
+		})
+	})
+}
+
+func notExist(op, id string) error {
+	return &os.PathError{Op: op, Path: id, Err: os.ErrNotExist}
+}
+
+// Lock takes the lock of the container, see Store.Lock
+func (s *BoltStore) Lock(id string) error {
+	return s.lock(id)
+}
+
+// Unlock releases the lock of the container, see Store.Unlock
+func (s *BoltStore) Unlock(id string, removed bool) error {
+	return s.unlock(id, removed)
+}
+
+func (s *BoltStore) Save(id string, data []byte) error {
+	return s.update(func(b *bolt.Bucket) error {
+		return b.Put([]byte(id), data)
+	})
+}
+
+// Load returns the entry of the container, the error satisfies os.IsNotExist
+// if there is none
+func (s *BoltStore) Load(id string) ([]byte, error) {
+	var data []byte
+	err := s.view(func(b *bolt.Bucket) error {
+		var v []byte
+		if b != nil {
+			v = b.Get([]byte(id))
+		}
+		if v == nil {
+			return notExist("load", id)
+		}
+		// v is only valid in the transaction
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *BoltStore) Remove(id string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		if b.Get([]byte(id)) == nil {
+			return notExist("remove", id)
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// Quarantine moves the entry of the container into the quarantine bucket, the
+// key is suffixed with the time like the quarantined files
+func (s *BoltStore) Quarantine(id string) error {
+	return s.withDB(func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			entries := tx.Bucket([]byte(entriesBucket))
+			var v []byte
+			if entries != nil {
+				v = entries.Get([]byte(id))
+			}
+			if v == nil {
+				return notExist("quarantine", id)
+			}
+			quarantine, err := tx.CreateBucketIfNotExists([]byte(quarantineBucket))
+			if err != nil {
+				return err
+			}
+			key := fmt.Sprintf("%s.%d", id, time.Now().UnixNano())
+			if err := quarantine.Put([]byte(key), v); err != nil {
+				return err
+			}
+			return entries.Delete([]byte(id))
+		})
+	})
+}
+
+// Stat describes the entry of the container, the database does not record
+// the time of the last Save
+func (s *BoltStore) Stat(id string) (*EntryInfo, error) {
+	var info *EntryInfo
+	err := s.view(func(b *bolt.Bucket) error {
+		var v []byte
+		if b != nil {
+			v = b.Get([]byte(id))
+		}
+		if v == nil {
+			return notExist("stat", id)
+		}
+		info = &EntryInfo{ID: id, Size: int64(len(v))}
+		return nil
+	})
+	return info, err
+}
+
+// List returns the IDs of the containers with an entry
+func (s *BoltStore) List() ([]string, error) {
+	return s.ListPrefix("")
+}
+
+// ListPrefix returns the IDs of the containers with an entry starting with
+// prefix, in order
+func (s *BoltStore) ListPrefix(prefix string) ([]string, error) {
+	var ids []string
+	err := s.view(func(b *bolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Compact rewrites the database into a new file, bbolt reuses the pages of
+// removed entries but never shrinks the file
+func (s *BoltStore) Compact() error {
+	l, err := lockFile(s.lockPath(boltFile), s.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock(false)
+
+	if _, err := os.Stat(s.dbPath()); os.IsNotExist(err) {
+		return nil
+	}
+	src, err := bolt.Open(s.dbPath(), 0600, &bolt.Options{Timeout: s.lockTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := s.dbPath() + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: s.lockTimeout})
+	if err != nil {
+		return err
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+				db, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return sb.ForEach(func(k, v []byte) error {
+					return db.Put(k, v)
+				})
+			})
+		})
+	})
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.dbPath()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(s.dataDir)
+}
+
+// Import moves the entries of the file store on the same dataDir into the
+// database, so switching the store of a node keeps the delegates of the
+// running containers. Containers locked by a command in progress are left for
+// a later Import.
+func (s *BoltStore) Import(files *Store) (int, error) {
+	ids, err := files.List()
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, id := range ids {
+		l, err := lockFile(s.lockPath(id), 0)
+		if err != nil {
+			continue
+		}
+		ok, err := s.importEntry(files, id)
+		l.Unlock(false)
+		if err != nil {
+			return imported, err
+		}
+		if ok {
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+func (s *BoltStore) importEntry(files *Store, id string) (bool, error) {
+	data, err := files.Load(id)
+	if err != nil {
+		// removed in the meantime, or quarantined
+		if os.IsNotExist(err) || err == ErrCorruptEntry {
+			return false, nil
+		}
+		return false, err
+	}
+
+	imported := false
+	err = s.update(func(b *bolt.Bucket) error {
+		// an entry saved in the database is newer
+		if b.Get([]byte(id)) != nil {
+			return nil
+		}
+		imported = true
+		return b.Put([]byte(id), data)
+	})
+	if err != nil {
+		return false, err
+	}
+	return imported, files.Remove(id)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
+// SaveEntry saves the cache entry of the container in the current format
+func SaveEntry(store CNIStore, id string, entry *types.CacheEntry) error {
+	entry.Version = types.CacheVersion
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error serializing cache entry: %v", err)
+	}
+	return store.Save(id, data)
+}
+
+// LoadEntry loads the cache entry of the container, see DecodeEntry. An entry
+// which can't be decoded, e.g. of the wrong shape or written by a newer
+// multus, is quarantined and ErrCorruptEntry is returned, so the commands of
+// the container do not fail on it forever.
+func LoadEntry(store CNIStore, id string) (*types.CacheEntry, error) {
+	data, err := store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := DecodeEntry(data)
+	if err != nil {
+		logging.Errorf("LoadEntry: quarantine the entry of %s: %v", id, err)
+		if err := store.Quarantine(id); err != nil {
+			return nil, fmt.Errorf("%v, and failed to quarantine it: %v", ErrCorruptEntry, err)
+		}
+		return nil, ErrCorruptEntry
+	}
+	return entry, nil
+}
+
+// legacyDelegate is a delegate of the bare delegates array, which may carry
+// the pod UID
+type legacyDelegate struct {
+	types.DelegateNetConf
+	PodUID string `json:"podUID"`
+}
+
+// DecodeEntry parses a cache entry. The bare delegates arrays of older
+// multus are returned as entries of version 0, the ifname of every delegate
+// is its requested ifname.
+func DecodeEntry(data []byte) (*types.CacheEntry, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		entry := &types.CacheEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("failed to parse cache entry: %v", err)
+		}
+		if entry.Version > types.CacheVersion {
+			return nil, fmt.Errorf("cache entry version %d is newer than %d", entry.Version, types.CacheVersion)
+		}
+		return entry, nil
+	}
+
+	var legacy []*legacyDelegate
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("failed to parse legacy cache entry: %v", err)
+	}
+	entry := &types.CacheEntry{}
+	for _, delegate := range legacy {
+		conf := delegate.DelegateNetConf
+		entry.Delegates = append(entry.Delegates, &types.CacheDelegate{
+			IfName: conf.IfnameRequest,
+			Conf:   &conf,
+		})
+		if entry.PodUID == "" {
+			entry.PodUID = delegate.PodUID
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	lockDir = ".locks"
+
+	// DefaultLockTimeout bounds the wait for an ADD or DEL of the same
+	// container, kubelet retries the command after it fails
+	DefaultLockTimeout = 60 * time.Second
+
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+// FileLock is an advisory lock on a file shared by multus processes
+type FileLock struct {
+	f *os.File
+}
+
+// lockFile locks the file exclusively, waiting at most timeout. The lock file
+// may be removed by its previous holder, so the lock is only taken if it is
+// still on the path.
+func lockFile(path string, timeout time.Duration) (*FileLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+				break
+			}
+			if time.Now().After(deadline) {
+				f.Close()
+				return nil, fmt.Errorf("timeout after %v waiting for lock %s", timeout, path)
+			}
+			time.Sleep(lockRetryInterval)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if sameFile(f, path) {
+			return &FileLock{f: f}, nil
+		}
+		// the holder removed the file, lock the new one
+		f.Close()
+	}
+}
+
+func sameFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+// Unlock releases the lock, if remove is set the lock file is removed first
+func (l *FileLock) Unlock(remove bool) error {
+	if remove {
+		if err := os.Remove(l.f.Name()); err != nil && !os.IsNotExist(err) {
+			l.f.Close()
+			return err
+		}
+	}
+	return l.f.Close()
+}
+
+// locker holds the container locks of a store, the lock files are shared by
+// all stores on the same dataDir
+type locker struct {
+	lockDir     string
+	lockTimeout time.Duration
+	locks       map[string]*FileLock
+}
+
+func newLocker(dataDir string) locker {
+	return locker{
+		lockDir:     filepath.Join(dataDir, lockDir),
+		lockTimeout: DefaultLockTimeout,
+		locks:       make(map[string]*FileLock),
+	}
+}
+
+func (l *locker) lock(id string) error {
+	if _, ok := l.locks[id]; ok {
+		return fmt.Errorf("lock of %s is already held", id)
+	}
+	fl, err := lockFile(l.lockPath(id), l.lockTimeout)
+	if err != nil {
+		return err
+	}
+	l.locks[id] = fl
+	return nil
+}
+
+// unlock releases the lock of the container, if remove is set the lock file
+// is removed
+func (l *locker) unlock(id string, remove bool) error {
+	fl, ok := l.locks[id]
+	if !ok {
+		return fmt.Errorf("lock of %s is not held", id)
+	}
+	delete(l.locks, id)
+	return fl.Unlock(remove)
+}
+
+func (l *locker) lockPath(id string) string {
+	return GetEscapedPath(l.lockDir, id)
+}
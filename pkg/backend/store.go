@@ -1,7 +1,82 @@
 package backend
 
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
 type CNIStore interface {
+	// Lock and Unlock serialize the commands of the same container, the
+	// caller which removed the entry sets removed so the lock file goes too
+	Lock(id string) error
+	Unlock(id string, removed bool) error
 	Save(id string, data []byte) error
 	Load(id string) ([]byte, error)
 	Remove(id string) error
+	// Quarantine moves the entry of the container out of the way, it is
+	// kept for inspection but unknown to the store afterwards
+	Quarantine(id string) error
+	// List returns the IDs of the containers with an entry
+	List() ([]string, error)
+	// Stat describes the entry of the container without loading it, the
+	// error satisfies os.IsNotExist if there is none
+	Stat(id string) (*EntryInfo, error)
+}
+
+// EntryInfo describes an entry of the store
+type EntryInfo struct {
+	ID   string
+	Size int64
+	// ModTime is the time of the last Save, zero if the store does not
+	// record it
+	ModTime time.Time
+}
+
+// importedFile marks a dataDir whose file store entries are all in the
+// database
+const importedFile = ".multus.db.imported"
+
+// NewCNIStore returns the store of the backend in dataDir. The bolt store
+// imports the entries left by the file store until none is left, the file
+// store drops the mark again so a later switch back to bolt imports its
+// entries.
+func NewCNIStore(backend string, dataDir string) (CNIStore, error) {
+	if backend != types.StoreBolt {
+		store, err := NewStore(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Remove(filepath.Join(store.dataDir, importedFile)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	store, err := NewBoltStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	marker := filepath.Join(store.dataDir, importedFile)
+	if _, err := os.Stat(marker); err == nil {
+		return store, nil
+	}
+	files, err := NewStore(store.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.Import(files); err != nil {
+		return nil, err
+	}
+	// the entries locked by a command in progress are left for the next one
+	if ids, err := files.List(); err != nil || len(ids) != 0 {
+		return store, nil
+	}
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		return nil, err
+	}
+	return store, nil
 }
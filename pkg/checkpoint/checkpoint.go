@@ -0,0 +1,71 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+)
+
+const DefaultCheckpointFile = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
+
+// podDevicesEntry is a device allocation of kubelet to a container
+type podDevicesEntry struct {
+	PodUID        string
+	ContainerName string
+	ResourceName  string
+	DeviceIDs     []string
+}
+
+type checkpointData struct {
+	PodDeviceEntries []podDevicesEntry
+}
+
+// checkpointFile holds both checkpoint formats of kubelet, the data is at
+// the top level before kubernetes 1.12 and wrapped with a checksum since
+type checkpointFile struct {
+	Data *checkpointData
+	checkpointData
+}
+
+// GetPodDevices returns the device IDs kubelet allocated to the containers of
+// the pod, keyed by resource name
+func GetPodDevices(file string, podUID string) (map[string][]string, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, logging.Errorf("GetPodDevices: failed to read kubelet checkpoint: %v", err)
+	}
+
+	cp := &checkpointFile{}
+	if err := json.Unmarshal(bytes, cp); err != nil {
+		return nil, logging.Errorf("GetPodDevices: failed to parse kubelet checkpoint %s: %v", file, err)
+	}
+	entries := cp.PodDeviceEntries
+	if cp.Data != nil {
+		entries = cp.Data.PodDeviceEntries
+	}
+
+	devices := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.PodUID != podUID {
+			continue
+		}
+		devices[entry.ResourceName] = append(devices[entry.ResourceName], entry.DeviceIDs...)
+	}
+	logging.Debugf("GetPodDevices: pod %s, devices %v", podUID, devices)
+	return devices, nil
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCheckpoint(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "checkpoint")
+}
+
+var _ = Describe("checkpoint", func() {
+	var tmpDir, file string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		file = filepath.Join(tmpDir, "kubelet_internal_checkpoint")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("reads the devices of the pod", func() {
+		Expect(ioutil.WriteFile(file, []byte(`{
+    "Data": {
+        "PodDeviceEntries": [
+            {"PodUID": "uid1", "ContainerName": "c1", "ResourceName": "intel.com/sriov", "DeviceIDs": ["0000:03:02.0"], "AllocResp": "CiQKFA=="},
+            {"PodUID": "uid1", "ContainerName": "c2", "ResourceName": "intel.com/sriov", "DeviceIDs": ["0000:03:02.1"], "AllocResp": "CiQKFA=="},
+            {"PodUID": "uid2", "ContainerName": "c1", "ResourceName": "intel.com/sriov", "DeviceIDs": ["0000:03:02.2"], "AllocResp": "CiQKFA=="},
+            {"PodUID": "uid1", "ContainerName": "c1", "ResourceName": "nvidia.com/gpu", "DeviceIDs": ["GPU-1"], "AllocResp": "CiQKFA=="}
+        ],
+        "RegisteredDevices": {"intel.com/sriov": ["0000:03:02.0", "0000:03:02.1", "0000:03:02.2"]}
+    },
+    "Checksum": 1234567890
+}`), 0644)).To(Succeed())
+
+		devices, err := GetPodDevices(file, "uid1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(Equal(map[string][]string{
+			"intel.com/sriov": {"0000:03:02.0", "0000:03:02.1"},
+			"nvidia.com/gpu":  {"GPU-1"},
+		}))
+
+		devices, err = GetPodDevices(file, "uid3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(BeEmpty())
+	})
+
+	It("reads the checkpoint format before kubernetes 1.12", func() {
+		Expect(ioutil.WriteFile(file, []byte(`{
+    "PodDeviceEntries": [
+        {"PodUID": "uid1", "ContainerName": "c1", "ResourceName": "intel.com/sriov", "DeviceIDs": ["0000:03:02.0"]}
+    ],
+    "RegisteredDevices": {"intel.com/sriov": ["0000:03:02.0"]}
+}`), 0644)).To(Succeed())
+
+		devices, err := GetPodDevices(file, "uid1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(HaveKeyWithValue("intel.com/sriov", []string{"0000:03:02.0"}))
+	})
+
+	It("fails without the checkpoint", func() {
+		_, err := GetPodDevices(file, "uid1")
+		Expect(err).To(HaveOccurred())
+	})
+})
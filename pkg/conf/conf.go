@@ -17,6 +17,7 @@ package conf
 
 import (
 	"encoding/json"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
@@ -30,6 +31,7 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 
 	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/qyzhaoxun/multus-cni/pkg/checkpoint"
 	"github.com/qyzhaoxun/multus-cni/pkg/logging"
 	mtypes "github.com/qyzhaoxun/multus-cni/pkg/types"
 	"github.com/qyzhaoxun/multus-cni/pkg/utils"
@@ -39,8 +41,22 @@ const (
 	defaultCNIDir  = "/var/lib/cni/networks/multus"
 	defaultConfDir = "/etc/cni/net.d/multus"
 	defaultBinDir  = "/opt/cni/bin"
+
+	defaultAnnotationCacheDir = "/var/lib/cni/multus/annotations"
+	defaultKubeTimeout        = 10
 )
 
+// deviceIDCapability passes the device allocated to the pod in runtimeConfig
+const deviceIDCapability = "deviceID"
+
+// masterOnlyCapabilities are only injected into the master plugin unless a
+// secondary network opts in with secondaryCapabilities, otherwise every
+// network of the pod would set up the same port mappings or traffic shaping
+var masterOnlyCapabilities = map[string]bool{
+	"portMappings": true,
+	"bandwidth":    true,
+}
+
 func LoadDelegateNetConfList(bytes []byte, delegateConf *mtypes.DelegateNetConf) error {
 	logging.Debugf("LoadDelegateNetConfList: %s, %v", string(bytes), delegateConf)
 	if err := json.Unmarshal(bytes, &delegateConf.ConfList); err != nil {
@@ -75,20 +91,30 @@ func LoadDelegateNetConf(bytes []byte, isConfList bool, ifnameRequest string) (*
 		delegateConf.IfnameRequest = ifnameRequest
 	}
 
+	options := &struct {
+		SecondaryCapabilities []string `json:"secondaryCapabilities"`
+		ResourceName          string   `json:"resourceName"`
+	}{}
+	if err := json.Unmarshal(bytes, options); err != nil {
+		return nil, logging.Errorf("error in LoadDelegateNetConf - unmarshalling delegate options: %v", err)
+	}
+	delegateConf.SecondaryCapabilities = options.SecondaryCapabilities
+	delegateConf.ResourceName = options.ResourceName
+
 	delegateConf.Bytes = bytes
 
 	return delegateConf, nil
 }
 
-func LoadCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *mtypes.K8sArgs, ifName string, rc map[string]interface{}) (*libcni.RuntimeConf, error) {
-	logging.Debugf("LoadCNIRuntimeConf: %v, %s, %v", k8sArgs, ifName, rc)
+func LoadCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *mtypes.K8sArgs, delegate *mtypes.DelegateNetConf, rc map[string]interface{}) (*libcni.RuntimeConf, error) {
+	logging.Debugf("LoadCNIRuntimeConf: %v, %s, %v", k8sArgs, delegate, rc)
 	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go#buildCNIRuntimeConf
 	// Todo
 	// ingress, egress and bandwidth capability features as same as kubelet.
 	rt := &libcni.RuntimeConf{
 		ContainerID: args.ContainerID,
 		NetNS:       args.Netns,
-		IfName:      ifName,
+		IfName:      delegate.IfnameRequest,
 		Args: [][2]string{
 			{"IgnoreUnknown", "1"},
 			{"K8S_POD_NAMESPACE", string(k8sArgs.K8S_POD_NAMESPACE)},
@@ -97,14 +123,80 @@ func LoadCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *mtypes.K8sArgs, ifName stri
 		},
 	}
 
-	if rc != nil {
-		rt.CapabilityArgs = rc
+	// the deviceID capability does not come from the runtimeConfig
+	if rc != nil || delegate.DeviceID != "" {
+		rt.CapabilityArgs = LoadCapabilityArgs(delegate, rc)
 	}
 	return rt, nil
 }
 
-func LoadNetworkStatus(r types.Result, netName string, defaultNet bool) (*mtypes.NetworkStatus, error) {
-	logging.Debugf("LoadNetworkStatus: %v, %s, %t", r, netName, defaultNet)
+// GetDelegateCapabilities returns the capabilities the delegate declares, for
+// a conflist it is the union of the capabilities of all its plugins
+func GetDelegateCapabilities(delegate *mtypes.DelegateNetConf) map[string]bool {
+	caps := make(map[string]bool)
+	if delegate.ConfListPlugin {
+		for _, plugin := range delegate.ConfList.Plugins {
+			for capability, supported := range plugin.Capabilities {
+				if supported {
+					caps[capability] = true
+				}
+			}
+		}
+		return caps
+	}
+
+	for capability, supported := range delegate.Conf.Capabilities {
+		if supported {
+			caps[capability] = true
+		}
+	}
+	return caps
+}
+
+// LoadCapabilityArgs filters the multus runtimeConfig down to the capabilities
+// the delegate declares. Master only capabilities are dropped for secondary
+// networks unless they are listed in the delegate's secondaryCapabilities.
+func LoadCapabilityArgs(delegate *mtypes.DelegateNetConf, rc map[string]interface{}) map[string]interface{} {
+	optIn := make(map[string]bool)
+	for _, capability := range delegate.SecondaryCapabilities {
+		optIn[capability] = true
+	}
+
+	capabilityArgs := make(map[string]interface{})
+	var injected, skipped []string
+	caps := GetDelegateCapabilities(delegate)
+	if delegate.DeviceID != "" && caps[deviceIDCapability] {
+		capabilityArgs[deviceIDCapability] = delegate.DeviceID
+		injected = append(injected, deviceIDCapability)
+	}
+	for capability := range caps {
+		data, ok := rc[capability]
+		if !ok || capability == deviceIDCapability {
+			continue
+		}
+		if masterOnlyCapabilities[capability] && !delegate.MasterPlugin && !optIn[capability] {
+			skipped = append(skipped, capability)
+			continue
+		}
+		capabilityArgs[capability] = data
+		injected = append(injected, capability)
+	}
+
+	sort.Strings(injected)
+	sort.Strings(skipped)
+	logging.Infof("LoadCapabilityArgs: network %s, master %t, injected capabilities %v, skipped master only capabilities %v",
+		delegate.Name(), delegate.MasterPlugin, injected, skipped)
+	return capabilityArgs
+}
+
+// LoadNetworkStatus converts a delegate result into network status entries,
+// one for every sandbox interface of the result. IPs are assigned by their
+// interface index, routes to the interface whose subnet holds the gateway.
+// IPs without interface index and routes without gateway go to the first
+// entry. ifName is the delegate interface, it is the default entry of the
+// default network.
+func LoadNetworkStatus(r types.Result, netName string, ifName string, defaultNet bool) ([]*mtypes.NetworkStatus, error) {
+	logging.Debugf("LoadNetworkStatus: %v, %s, %s, %t", r, netName, ifName, defaultNet)
 
 	// Convert whatever the IPAM result was into the current Result type
 	result, err := current.NewResultFromResult(r)
@@ -112,34 +204,112 @@ func LoadNetworkStatus(r types.Result, netName string, defaultNet bool) (*mtypes
 		return nil, logging.Errorf("error convert the type.Result to current.Result: %v", err)
 	}
 
-	netstatus := &mtypes.NetworkStatus{}
-	netstatus.Name = netName
-	netstatus.Default = defaultNet
-
-	for _, ifs := range result.Interfaces {
+	var netstatuses []*mtypes.NetworkStatus
+	// result interface index => status entry
+	entries := make(map[int]*mtypes.NetworkStatus)
+	for idx, ifs := range result.Interfaces {
 		//Only pod interfaces can have sandbox information
-		if ifs.Sandbox != "" {
-			netstatus.Interface = ifs.Name
-			netstatus.Mac = ifs.Mac
+		if ifs.Sandbox == "" {
+			continue
+		}
+		netstatus := &mtypes.NetworkStatus{
+			Name:      netName,
+			Interface: ifs.Name,
+			Mac:       ifs.Mac,
+			DNS:       result.DNS,
+			State:     mtypes.NetworkStateOK,
+		}
+		entries[idx] = netstatus
+		netstatuses = append(netstatuses, netstatus)
+	}
+	if len(netstatuses) == 0 {
+		netstatuses = append(netstatuses, &mtypes.NetworkStatus{
+			Name:  netName,
+			DNS:   result.DNS,
+			State: mtypes.NetworkStateOK,
+		})
+	}
+
+	if defaultNet {
+		defaultStatus := netstatuses[0]
+		for _, netstatus := range netstatuses {
+			if netstatus.Interface == ifName {
+				defaultStatus = netstatus
+				break
+			}
 		}
+		defaultStatus.Default = true
 	}
 
 	for _, ipconfig := range result.IPs {
-		if ipconfig.Version == "4" && ipconfig.Address.IP.To4() != nil {
-			netstatus.IPs = append(netstatus.IPs, ipconfig.Address.IP.String())
+		if ipconfig.Version == "4" && ipconfig.Address.IP.To4() == nil {
+			continue
+		}
+		if ipconfig.Version == "6" && ipconfig.Address.IP.To16() == nil {
+			continue
 		}
 
-		if ipconfig.Version == "6" && ipconfig.Address.IP.To16() != nil {
-			netstatus.IPs = append(netstatus.IPs, ipconfig.Address.IP.String())
+		netstatus := netstatuses[0]
+		if ipconfig.Interface != nil {
+			if entry, ok := entries[*ipconfig.Interface]; ok {
+				netstatus = entry
+			}
+		}
+		netstatus.IPs = append(netstatus.IPs, ipconfig.Address.IP.String())
+		netstatus.CIDRs = append(netstatus.CIDRs, ipconfig.Address.String())
+		if ipconfig.Gateway != nil {
+			netstatus.Gateways = append(netstatus.Gateways, ipconfig.Gateway.String())
 		}
 	}
 
-	netstatus.DNS = result.DNS
+	for _, route := range result.Routes {
+		netstatus := netstatuses[0]
+		if route.GW != nil {
+		lookup:
+			for _, entry := range netstatuses {
+				for _, cidr := range entry.CIDRs {
+					_, subnet, err := net.ParseCIDR(cidr)
+					if err == nil && subnet.Contains(route.GW) {
+						netstatus = entry
+						break lookup
+					}
+				}
+			}
+		}
+		netstatus.Routes = append(netstatus.Routes, route)
+	}
 
-	return netstatus, nil
+	return netstatuses, nil
 }
 
+// LoadNetConf parses the multus config and checks its inline delegates, the
+// default delegates are loaded as the delegates if loadDefaultDelegates is set
 func LoadNetConf(bytes []byte, loadDefaultDelegates bool) (*mtypes.NetConf, error) {
+	netconf, err := ParseNetConf(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkInlineDelegates(netconf.RawDelegates); err != nil {
+		return nil, logging.Errorf("failed to load inline delegates from config: %v", err)
+	}
+
+	if loadDefaultDelegates && netconf.DefaultDelegates != "" {
+		delegates, err := GetDefaultDelegates(netconf)
+		if err != nil {
+			return nil, logging.Errorf("failed to load default delegates from config: %v", err)
+		}
+		for idx := range delegates {
+			netconf.Delegates = append(netconf.Delegates, delegates[idx])
+		}
+	}
+
+	return netconf, nil
+}
+
+// ParseNetConf parses the multus config and sets the defaults, the inline
+// delegates are not checked
+func ParseNetConf(bytes []byte) (*mtypes.NetConf, error) {
 	netconf := &mtypes.NetConf{}
 
 	if err := json.Unmarshal(bytes, netconf); err != nil {
@@ -175,6 +345,10 @@ func LoadNetConf(bytes []byte, loadDefaultDelegates bool) (*mtypes.NetConf, erro
 		netconf.CNIDir = defaultCNIDir
 	}
 
+	if netconf.VersionCacheFile == "" {
+		netconf.VersionCacheFile = filepath.Join(netconf.CNIDir, versionCacheFile)
+	}
+
 	if netconf.ConfDir == "" {
 		netconf.ConfDir = defaultConfDir
 	}
@@ -183,31 +357,81 @@ func LoadNetConf(bytes []byte, loadDefaultDelegates bool) (*mtypes.NetConf, erro
 		netconf.BinDir = defaultBinDir
 	}
 
-	if loadDefaultDelegates && netconf.DefaultDelegates != "" {
-		delegates, err := GetDefaultDelegates(netconf.DefaultDelegates, netconf.ConfDir)
-		if err != nil {
-			return nil, logging.Errorf("failed to load default delegates from config: %v", err)
-		}
-		for idx := range delegates {
-			netconf.Delegates = append(netconf.Delegates, delegates[idx])
-		}
+	switch netconf.ApiserverFallback {
+	case "":
+		netconf.ApiserverFallback = mtypes.ApiserverFallbackFail
+	case mtypes.ApiserverFallbackFail, mtypes.ApiserverFallbackDefaultDelegates, mtypes.ApiserverFallbackCache:
+	default:
+		return nil, logging.Errorf("unknown apiserverFallback %q, must be one of %s, %s, %s", netconf.ApiserverFallback,
+			mtypes.ApiserverFallbackFail, mtypes.ApiserverFallbackDefaultDelegates, mtypes.ApiserverFallbackCache)
+	}
+
+	if netconf.AnnotationCacheDir == "" {
+		netconf.AnnotationCacheDir = defaultAnnotationCacheDir
+	}
+
+	switch netconf.Store {
+	case "":
+		netconf.Store = mtypes.StoreFile
+	case mtypes.StoreFile, mtypes.StoreBolt:
+	default:
+		return nil, logging.Errorf("unknown store %q, must be one of %s, %s", netconf.Store, mtypes.StoreFile, mtypes.StoreBolt)
+	}
+
+	if netconf.KubeTimeout < 0 || netconf.KubeQPS < 0 || netconf.KubeBurst < 0 {
+		return nil, logging.Errorf("kubeTimeout, kubeQPS and kubeBurst must not be negative")
+	}
+	if netconf.KubeTimeout == 0 {
+		netconf.KubeTimeout = defaultKubeTimeout
+	}
+
+	if netconf.KubeletCheckpointFile == "" {
+		netconf.KubeletCheckpointFile = checkpoint.DefaultCheckpointFile
 	}
 
 	return netconf, nil
 }
 
-func GetDefaultDelegates(delegatesAnnot, confdir string) ([]*mtypes.DelegateNetConf, error) {
-	networks, err := utils.ParsePodNetworkAnnotation(delegatesAnnot, "")
+func GetDefaultDelegates(netconf *mtypes.NetConf) ([]*mtypes.DelegateNetConf, error) {
+	delegates, err := getDelegatesByNetworks(netconf, netconf.DefaultDelegates)
+	if err != nil {
+		return nil, logging.Errorf("GetDefaultDelegates: %v", err)
+	}
+	return delegates, nil
+}
+
+// GetDelOnlyDelegates returns the delegates torn down by a recovered DEL of a
+// pod which is gone, delOnlyDelegates or else defaultDelegates
+func GetDelOnlyDelegates(netconf *mtypes.NetConf) ([]*mtypes.DelegateNetConf, error) {
+	networks := netconf.DelOnlyDelegates
+	if networks == "" {
+		networks = netconf.DefaultDelegates
+	}
+	if networks == "" {
+		return nil, nil
+	}
+
+	delegates, err := getDelegatesByNetworks(netconf, networks)
+	if err != nil {
+		return nil, logging.Errorf("GetDelOnlyDelegates: %v", err)
+	}
+	return delegates, nil
+}
+
+// getDelegatesByNetworks reads the delegates of networks, written like the
+// network annotation
+func getDelegatesByNetworks(netconf *mtypes.NetConf, networks string) ([]*mtypes.DelegateNetConf, error) {
+	elements, err := utils.ParsePodNetworkAnnotation(networks, "")
 	if err != nil {
 		return nil, err
 	}
 
 	// Read all network objects referenced by 'networks'
 	var delegates []*mtypes.DelegateNetConf
-	for _, net := range networks {
-		delegate, err := GetDelegateFromFile(net, confdir)
+	for _, net := range elements {
+		delegate, err := GetDelegate(net, netconf)
 		if err != nil {
-			return nil, logging.Errorf("GetDefaultDelegates: failed getting the delegate: %v", err)
+			return nil, logging.Errorf("failed getting the delegate: %v", err)
 		}
 		delegates = append(delegates, delegate)
 	}
@@ -215,6 +439,90 @@ func GetDefaultDelegates(delegatesAnnot, confdir string) ([]*mtypes.DelegateNetC
 	return delegates, nil
 }
 
+// param => confBytes; return => confName, confList, error
+func parseInlineDelegate(bytes []byte) (string, bool, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return "", false, logging.Errorf("error parsing inline delegate: %v", err)
+	}
+
+	if _, ok := raw["plugins"]; ok {
+		confList, err := libcni.ConfListFromBytes(bytes)
+		if err != nil {
+			return "", false, logging.Errorf("error loading inline delegate conflist: %v", err)
+		}
+		return confList.Name, true, nil
+	}
+
+	conf, err := libcni.ConfFromBytes(bytes)
+	if err != nil {
+		return "", false, logging.Errorf("error loading inline delegate config: %v", err)
+	}
+	if conf.Network.Name == "" {
+		return "", false, logging.Errorf("error loading inline delegate config: missing 'name'")
+	}
+	return conf.Network.Name, false, nil
+}
+
+// checkInlineDelegates makes sure every inline delegate is a valid conf or
+// conflist and that no two of them share the same name
+func checkInlineDelegates(rawDelegates []json.RawMessage) error {
+	names := make(map[string]int)
+	for idx, rawDelegate := range rawDelegates {
+		name, _, err := parseInlineDelegate(rawDelegate)
+		if err != nil {
+			return logging.Errorf("invalid delegate %d: %v", idx, err)
+		}
+		if i, ok := names[name]; ok {
+			return logging.Errorf("delegate %d and %d have the same name %s", i, idx, name)
+		}
+		names[name] = idx
+	}
+	return nil
+}
+
+// LoadInlineDelegates loads every inline delegate of the multus config, the
+// problems of all delegates are returned with the valid delegates
+func LoadInlineDelegates(netconf *mtypes.NetConf) ([]*mtypes.DelegateNetConf, []error) {
+	var delegates []*mtypes.DelegateNetConf
+	var errs []error
+	names := make(map[string]int)
+	for idx, rawDelegate := range netconf.RawDelegates {
+		name, isConfList, err := parseInlineDelegate(rawDelegate)
+		if err != nil {
+			errs = append(errs, logging.Errorf("invalid delegate %d: %v", idx, err))
+			continue
+		}
+		if i, ok := names[name]; ok {
+			errs = append(errs, logging.Errorf("delegate %d and %d have the same name %s", i, idx, name))
+			continue
+		}
+		names[name] = idx
+		delegate, err := LoadDelegateNetConf(rawDelegate, isConfList, "")
+		if err != nil {
+			errs = append(errs, logging.Errorf("delegate %d: %v", idx, err))
+			continue
+		}
+		delegates = append(delegates, delegate)
+	}
+	return delegates, errs
+}
+
+// param => confName, rawDelegates; return => confBytes, confList, found
+func getCNIConfigFromInline(name string, rawDelegates []json.RawMessage) ([]byte, bool, bool) {
+	for _, rawDelegate := range rawDelegates {
+		confName, isConfList, err := parseInlineDelegate(rawDelegate)
+		if err != nil {
+			// checked by LoadNetConf already
+			continue
+		}
+		if confName == name {
+			return rawDelegate, isConfList, true
+		}
+	}
+	return nil, false, false
+}
+
 // param => confName, confDir; return => confBytes, confList, error
 func getCNIConfigFromFile(name string, confdir string) ([]byte, bool, error) {
 	logging.Debugf("getCNIConfigFromFile: %s, %s", name, confdir)
@@ -280,11 +588,33 @@ func GetDelegateFromFile(net *mtypes.NetworkSelectionElement, confdir string) (*
 	return delegate, nil
 }
 
+// GetDelegate loads the network referenced by net, the inline delegates of
+// the multus config take precedence over the network files in confDir
+func GetDelegate(net *mtypes.NetworkSelectionElement, netconf *mtypes.NetConf) (*mtypes.DelegateNetConf, error) {
+	configBytes, isConfList, ok := getCNIConfigFromInline(net.Name, netconf.RawDelegates)
+	if !ok {
+		return GetDelegateFromFile(net, netconf.ConfDir)
+	}
+
+	logging.Infof("GetDelegate: found inline delegate %+v", net)
+	delegate, err := LoadDelegateNetConf(configBytes, isConfList, net.InterfaceRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return delegate, nil
+}
+
+// GetBinDirs returns the directories delegate plugins are searched in
+func GetBinDirs(binDir string) []string {
+	binDirs := filepath.SplitList(os.Getenv("CNI_PATH"))
+	return append(binDirs, binDir)
+}
+
 func ConflistAdd(rt *libcni.RuntimeConf, rawnetconflist []byte, binDir string, exec invoke.Exec) (cnitypes.Result, error) {
 	logging.Debugf("conflistAdd: %v, %s, %s", rt, string(rawnetconflist), binDir)
 	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go
-	binDirs := filepath.SplitList(os.Getenv("CNI_PATH"))
-	binDirs = append(binDirs, binDir)
+	binDirs := GetBinDirs(binDir)
 	cniNet := libcni.NewCNIConfig(binDirs, exec)
 
 	confList, err := libcni.ConfListFromBytes(rawnetconflist)
@@ -322,8 +652,7 @@ func ConflistDel(rt *libcni.RuntimeConf, rawnetconflist []byte, binDir string) e
 func ConfAdd(rt *libcni.RuntimeConf, rawnetconf []byte, binDir string, exec invoke.Exec) (cnitypes.Result, error) {
 	logging.Debugf("confAdd: %v, %s, %s", rt, string(rawnetconf), binDir)
 	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go
-	binDirs := filepath.SplitList(os.Getenv("CNI_PATH"))
-	binDirs = append(binDirs, binDir)
+	binDirs := GetBinDirs(binDir)
 	cniNet := libcni.NewCNIConfig(binDirs, exec)
 
 	conf, err := libcni.ConfFromBytes(rawnetconf)
@@ -357,3 +686,136 @@ func ConfDel(rt *libcni.RuntimeConf, rawnetconf []byte, binDir string) error {
 
 	return err
 }
+
+// ConflistGet runs GET on the conflist, GET needs cniVersion 0.4.0 or higher
+func ConflistGet(rt *libcni.RuntimeConf, rawnetconflist []byte, binDir string, exec invoke.Exec) (cnitypes.Result, error) {
+	logging.Debugf("conflistGet: %v, %s, %s", rt, string(rawnetconflist), binDir)
+	binDirs := GetBinDirs(binDir)
+	cniNet := libcni.NewCNIConfig(binDirs, exec)
+
+	confList, err := libcni.ConfListFromBytes(rawnetconflist)
+	if err != nil {
+		return nil, logging.Errorf("error in converting the raw bytes to conflist: %v", err)
+	}
+
+	result, err := cniNet.GetNetworkList(confList, rt)
+	if err != nil {
+		return nil, logging.Errorf("error in getting result from GetNetworkList: %v", err)
+	}
+
+	return result, nil
+}
+
+// ConfGet runs GET on the conf, GET needs cniVersion 0.4.0 or higher
+func ConfGet(rt *libcni.RuntimeConf, rawnetconf []byte, binDir string, exec invoke.Exec) (cnitypes.Result, error) {
+	logging.Debugf("confGet: %v, %s, %s", rt, string(rawnetconf), binDir)
+	binDirs := GetBinDirs(binDir)
+	cniNet := libcni.NewCNIConfig(binDirs, exec)
+
+	conf, err := libcni.ConfFromBytes(rawnetconf)
+	if err != nil {
+		return nil, logging.Errorf("error in converting the raw bytes to conf: %v", err)
+	}
+
+	result, err := cniNet.GetNetwork(conf, rt)
+	if err != nil {
+		return nil, logging.Errorf("error in getting result from GetNetwork: %v", err)
+	}
+
+	return result, nil
+}
+
+// LoadResult parses a result in the cniVersion it declares
+func LoadResult(bytes []byte) (cnitypes.Result, error) {
+	decoder := version.ConfigDecoder{}
+	resultVersion, err := decoder.Decode(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return version.NewResult(resultVersion, bytes)
+}
+
+// InjectPrevResult sets the ADD result of the delegate as prevResult in its
+// conf, or in every plugin of its conflist. libcni replaces it with its own
+// cached result of spec 0.4.0 and higher if there is one.
+func InjectPrevResult(delegate *mtypes.DelegateNetConf, prevResult []byte) ([]byte, error) {
+	if len(prevResult) == 0 {
+		return delegate.Bytes, nil
+	}
+
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(delegate.Bytes, &raw); err != nil {
+		return nil, err
+	}
+	result := json.RawMessage(prevResult)
+
+	if delegate.ConfListPlugin {
+		plugins, ok := raw["plugins"].([]interface{})
+		if !ok {
+			return nil, logging.Errorf("invalid plugins in conflist")
+		}
+		for _, plugin := range plugins {
+			if conf, ok := plugin.(map[string]interface{}); ok {
+				conf["prevResult"] = result
+			}
+		}
+	} else {
+		raw["prevResult"] = result
+	}
+
+	return json.Marshal(raw)
+}
+
+// SetDelegatesDeviceID assigns the devices kubelet allocated to the pod to the
+// delegates declaring a resourceName, in order, and sets deviceID in their
+// conf. With a conflist every plugin gets the deviceID.
+func SetDelegatesDeviceID(delegates []*mtypes.DelegateNetConf, devices map[string][]string) error {
+	used := make(map[string]int)
+	for _, delegate := range delegates {
+		if delegate.ResourceName == "" {
+			continue
+		}
+		deviceIDs := devices[delegate.ResourceName]
+		idx := used[delegate.ResourceName]
+		if idx >= len(deviceIDs) {
+			return logging.Errorf("SetDelegatesDeviceID: network %s: no device of resource %s left for the pod, %d allocated",
+				delegate.Name(), delegate.ResourceName, len(deviceIDs))
+		}
+		used[delegate.ResourceName]++
+
+		if err := setDelegateDeviceID(delegate, deviceIDs[idx]); err != nil {
+			return logging.Errorf("SetDelegatesDeviceID: network %s: %v", delegate.Name(), err)
+		}
+		logging.Infof("SetDelegatesDeviceID: network %s uses device %s of resource %s", delegate.Name(), deviceIDs[idx], delegate.ResourceName)
+	}
+	return nil
+}
+
+func setDelegateDeviceID(delegate *mtypes.DelegateNetConf, deviceID string) error {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(delegate.Bytes, &raw); err != nil {
+		return err
+	}
+
+	if delegate.ConfListPlugin {
+		plugins, ok := raw["plugins"].([]interface{})
+		if !ok {
+			return logging.Errorf("invalid plugins in conflist")
+		}
+		for _, plugin := range plugins {
+			if conf, ok := plugin.(map[string]interface{}); ok {
+				conf[deviceIDCapability] = deviceID
+			}
+		}
+	} else {
+		raw[deviceIDCapability] = deviceID
+	}
+
+	bytes, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	delegate.Bytes = bytes
+	delegate.DeviceID = deviceID
+	return nil
+}
@@ -16,8 +16,23 @@
 package conf
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+
+	testhelpers "github.com/qyzhaoxun/multus-cni/pkg/testing"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -27,13 +42,51 @@ func TestConf(t *testing.T) {
 	RunSpecs(t, "conf")
 }
 
+type fakeVersionExec struct {
+	version.PluginDecoder
+
+	versions map[string]version.PluginInfo
+	calls    int
+}
+
+func (f *fakeVersionExec) ExecPlugin(pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	Expect(environ).To(ContainElement("CNI_COMMAND=VERSION"))
+	f.calls++
+	pluginInfo, ok := f.versions[filepath.Base(pluginPath)]
+	if !ok {
+		return nil, fmt.Errorf("unknown CNI_COMMAND: VERSION")
+	}
+	var buf bytes.Buffer
+	Expect(pluginInfo.Encode(&buf)).To(Succeed())
+	return buf.Bytes(), nil
+}
+
+func (f *fakeVersionExec) FindInPath(plugin string, paths []string) (string, error) {
+	return filepath.Join(paths[len(paths)-1], plugin), nil
+}
+
 var _ = Describe("config operations", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	It("parses a valid multus configuration", func() {
 		conf := `{
     "name": "node-cni-network",
     "type": "multus",
     "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+    "defaultDelegates": "weave1",
     "delegates": [{
+        "name": "weave1",
         "type": "weave-net"
     }],
 	"runtimeConfig": {
@@ -43,12 +96,12 @@ var _ = Describe("config operations", func() {
     }
 
 }`
-		netConf, err := LoadNetConf([]byte(conf), false)
+		netConf, err := LoadNetConf([]byte(conf), true)
 		Expect(err).NotTo(HaveOccurred())
+		Expect(len(netConf.RawDelegates)).To(Equal(1))
 		Expect(len(netConf.Delegates)).To(Equal(1))
 		Expect(netConf.Delegates[0].Conf.Type).To(Equal("weave-net"))
-		Expect(netConf.Delegates[0].MasterPlugin).To(BeTrue())
-		//Expect(len(netConf.RuntimeConfig.PortMaps)).To(Equal(1))
+		Expect(netConf.RuntimeConfig).To(HaveKey("portMappings"))
 	})
 
 	It("succeeds if only delegates are set", func() {
@@ -56,18 +109,29 @@ var _ = Describe("config operations", func() {
     "name": "node-cni-network",
     "type": "multus",
     "delegates": [{
+        "name": "weave1",
         "type": "weave-net"
     },{
-        "type": "foobar"
+        "name": "other1",
+        "cniVersion": "0.3.1",
+        "plugins": [{
+            "type": "foobar"
+        }]
     }]
 }`
 		netConf, err := LoadNetConf([]byte(conf), false)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(len(netConf.Delegates)).To(Equal(2))
-		Expect(netConf.Delegates[0].Conf.Type).To(Equal("weave-net"))
-		Expect(netConf.Delegates[0].MasterPlugin).To(BeTrue())
-		Expect(netConf.Delegates[1].Conf.Type).To(Equal("foobar"))
-		Expect(netConf.Delegates[1].MasterPlugin).To(BeFalse())
+		Expect(len(netConf.RawDelegates)).To(Equal(2))
+		Expect(len(netConf.Delegates)).To(Equal(0))
+
+		netConf.DefaultDelegates = "other1,weave1@net2"
+		delegates, err := GetDefaultDelegates(netConf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(delegates)).To(Equal(2))
+		Expect(delegates[0].ConfListPlugin).To(BeTrue())
+		Expect(delegates[0].ConfList.Plugins[0].Type).To(Equal("foobar"))
+		Expect(delegates[1].Conf.Type).To(Equal("weave-net"))
+		Expect(delegates[1].IfnameRequest).To(Equal("net2"))
 	})
 
 	It("fails if no kubeconfig or delegates are set", func() {
@@ -75,15 +139,342 @@ var _ = Describe("config operations", func() {
     "name": "node-cni-network",
     "type": "multus"
 }`
-		_, err := LoadNetConf([]byte(conf), false)
+		netConf, err := LoadNetConf([]byte(conf), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(netConf.Delegates)).To(Equal(0))
+
+		_, err = GetDefaultDelegates(netConf)
 		Expect(err).To(HaveOccurred())
 	})
 
 	It("fails if kubeconfig is present but no delegates are set", func() {
+		conf := fmt.Sprintf(`{
+    "name": "node-cni-network",
+    "type": "multus",
+    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+    "confDir": "%s",
+    "defaultDelegates": "weave1"
+}`, tmpDir)
+		_, err := LoadNetConf([]byte(conf), true)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("prefers inline delegates over network files", func() {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, "10-weave1.conf"), []byte(`{
+    "name": "weave1",
+    "type": "from-file"
+}`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+		err = ioutil.WriteFile(filepath.Join(tmpDir, "20-net1.conf"), []byte(`{
+    "name": "net1",
+    "type": "mynet"
+}`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := fmt.Sprintf(`{
+    "name": "node-cni-network",
+    "type": "multus",
+    "confDir": %q,
+    "delegates": [{
+        "name": "weave1",
+        "type": "weave-net"
+    }]
+}`, tmpDir)
+		netConf, err := LoadNetConf([]byte(conf), false)
+		Expect(err).NotTo(HaveOccurred())
+
+		delegate, err := GetDelegate(&types.NetworkSelectionElement{Name: "weave1"}, netConf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delegate.Conf.Type).To(Equal("weave-net"))
+
+		delegate, err = GetDelegate(&types.NetworkSelectionElement{Name: "net1"}, netConf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delegate.Conf.Type).To(Equal("mynet"))
+	})
+
+	It("restricts master only capabilities to the master plugin", func() {
+		rc := map[string]interface{}{
+			"portMappings": []interface{}{map[string]interface{}{"hostPort": 8080, "containerPort": 80}},
+			"bandwidth":    map[string]interface{}{"ingressRate": 1000},
+			"ipRanges":     []interface{}{"10.0.0.0/24"},
+		}
+		args := &skel.CmdArgs{ContainerID: "123456789", Netns: "/var/run/netns/test"}
+		k8sArgs := &types.K8sArgs{}
+
+		master, err := LoadDelegateNetConf([]byte(`{
+    "name": "master",
+    "cniVersion": "0.3.1",
+    "plugins": [{
+        "type": "bridge",
+        "capabilities": {"ipRanges": true}
+    },{
+        "type": "portmap",
+        "capabilities": {"portMappings": true, "bandwidth": false}
+    }]
+}`), true, "eth0")
+		Expect(err).NotTo(HaveOccurred())
+		master.MasterPlugin = true
+		rt, err := LoadCNIRuntimeConf(args, k8sArgs, master, rc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.IfName).To(Equal("eth0"))
+		Expect(rt.CapabilityArgs).To(HaveLen(2))
+		Expect(rt.CapabilityArgs).To(HaveKey("portMappings"))
+		Expect(rt.CapabilityArgs).To(HaveKey("ipRanges"))
+
+		secondary, err := LoadDelegateNetConf([]byte(`{
+    "name": "secondary",
+    "type": "macvlan",
+    "capabilities": {"portMappings": true, "bandwidth": true, "ipRanges": true}
+}`), false, "net1")
+		Expect(err).NotTo(HaveOccurred())
+		rt, err = LoadCNIRuntimeConf(args, k8sArgs, secondary, rc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveLen(1))
+		Expect(rt.CapabilityArgs).To(HaveKey("ipRanges"))
+
+		optIn, err := LoadDelegateNetConf([]byte(`{
+    "name": "opt-in",
+    "type": "macvlan",
+    "secondaryCapabilities": ["bandwidth"],
+    "capabilities": {"portMappings": true, "bandwidth": true}
+}`), false, "net2")
+		Expect(err).NotTo(HaveOccurred())
+		rt, err = LoadCNIRuntimeConf(args, k8sArgs, optIn, rc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveLen(1))
+		Expect(rt.CapabilityArgs).To(HaveKey("bandwidth"))
+	})
+
+	It("passes the allocated devices to the delegates declaring a resourceName", func() {
+		sriov1, err := LoadDelegateNetConf([]byte(`{
+    "name": "sriov1",
+    "type": "sriov",
+    "resourceName": "intel.com/sriov"
+}`), false, "net1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sriov1.ResourceName).To(Equal("intel.com/sriov"))
+		sriov2, err := LoadDelegateNetConf([]byte(`{
+    "name": "sriov2",
+    "cniVersion": "0.3.1",
+    "resourceName": "intel.com/sriov",
+    "plugins": [{
+        "type": "sriov",
+        "capabilities": {"deviceID": true}
+    },{
+        "type": "tuning"
+    }]
+}`), true, "net2")
+		Expect(err).NotTo(HaveOccurred())
+		plain, err := LoadDelegateNetConf([]byte(`{"name": "plain", "type": "macvlan"}`), false, "net3")
+		Expect(err).NotTo(HaveOccurred())
+
+		delegates := []*types.DelegateNetConf{sriov1, plain, sriov2}
+		devices := map[string][]string{"intel.com/sriov": {"0000:03:02.0", "0000:03:02.1"}}
+		Expect(SetDelegatesDeviceID(delegates, devices)).To(Succeed())
+		Expect(sriov1.DeviceID).To(Equal("0000:03:02.0"))
+		Expect(string(sriov1.Bytes)).To(ContainSubstring(`"deviceID":"0000:03:02.0"`))
+		Expect(plain.DeviceID).To(BeEmpty())
+		Expect(string(plain.Bytes)).NotTo(ContainSubstring("deviceID"))
+
+		confList, err := libcni.ConfListFromBytes(sriov2.Bytes)
+		Expect(err).NotTo(HaveOccurred())
+		for _, plugin := range confList.Plugins {
+			Expect(string(plugin.Bytes)).To(ContainSubstring(`"deviceID":"0000:03:02.1"`))
+		}
+
+		args := &skel.CmdArgs{ContainerID: "123456789", Netns: "/var/run/netns/test"}
+		rt, err := LoadCNIRuntimeConf(args, &types.K8sArgs{}, sriov2, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("deviceID", "0000:03:02.1"))
+
+		// more networks than allocated devices
+		err = SetDelegatesDeviceID(delegates, map[string][]string{"intel.com/sriov": {"0000:03:02.0"}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no device of resource intel.com/sriov left"))
+	})
+
+	It("injects the ADD result of the delegate as prevResult", func() {
+		prevResult := []byte(`{"cniVersion":"0.4.0","ips":[{"version":"4","address":"10.0.0.2/24"}]}`)
+		bridge, err := LoadDelegateNetConf([]byte(`{"name": "bridge1", "cniVersion": "0.4.0", "type": "bridge"}`), false, "net1")
+		Expect(err).NotTo(HaveOccurred())
+		confBytes, err := InjectPrevResult(bridge, prevResult)
+		Expect(err).NotTo(HaveOccurred())
+		netConf, err := libcni.ConfFromBytes(confBytes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.Bytes).To(MatchJSON(`{"name": "bridge1", "cniVersion": "0.4.0", "type": "bridge", "prevResult": ` + string(prevResult) + `}`))
+
+		chain, err := LoadDelegateNetConf([]byte(`{
+    "name": "chain1",
+    "cniVersion": "0.4.0",
+    "plugins": [{"type": "bridge"}, {"type": "tuning"}]
+}`), true, "net2")
+		Expect(err).NotTo(HaveOccurred())
+		confBytes, err = InjectPrevResult(chain, prevResult)
+		Expect(err).NotTo(HaveOccurred())
+		confList, err := libcni.ConfListFromBytes(confBytes)
+		Expect(err).NotTo(HaveOccurred())
+		for _, plugin := range confList.Plugins {
+			Expect(string(plugin.Bytes)).To(ContainSubstring(`"prevResult":{"cniVersion":"0.4.0"`))
+		}
+
+		// without result the conf is unchanged
+		confBytes, err = InjectPrevResult(bridge, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(confBytes).To(Equal(bridge.Bytes))
+	})
+
+	It("rejects delegates whose plugins do not support the conf cniVersion", func() {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, "bridge"), []byte{}, 0755)
+		Expect(err).NotTo(HaveOccurred())
+		cacheFile := filepath.Join(tmpDir, "cache", "plugin-versions.json")
+		fExec := &fakeVersionExec{versions: map[string]version.PluginInfo{
+			"bridge":  version.PluginSupports("0.3.0", "0.3.1"),
+			"portmap": version.PluginSupports("0.3.1", "0.4.0"),
+		}}
+
+		bridge, err := LoadDelegateNetConf([]byte(`{
+    "name": "bridge1",
+    "cniVersion": "0.3.1",
+    "type": "bridge"
+}`), false, "")
+		Expect(err).NotTo(HaveOccurred())
+		err = CheckDelegateVersions([]*types.DelegateNetConf{bridge}, tmpDir, fExec, cacheFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.calls).To(Equal(1))
+
+		// the bridge binary is cached, portmap can't be stat'ed and is not
+		chain, err := LoadDelegateNetConf([]byte(`{
+    "name": "chain",
+    "cniVersion": "0.4.0",
+    "plugins": [{"type": "bridge"}, {"type": "portmap"}]
+}`), true, "")
+		Expect(err).NotTo(HaveOccurred())
+		legacy, err := LoadDelegateNetConf([]byte(`{
+    "name": "legacy",
+    "cniVersion": "0.2.0",
+    "type": "loopback"
+}`), false, "")
+		Expect(err).NotTo(HaveOccurred())
+		err = CheckDelegateVersions([]*types.DelegateNetConf{bridge, chain, legacy}, tmpDir, fExec, cacheFile)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("network chain: plugin bridge"))
+		Expect(err.Error()).NotTo(ContainSubstring("plugin portmap"))
+		Expect(err.Error()).To(ContainSubstring("network legacy: plugin loopback"))
+		Expect(fExec.calls).To(Equal(3))
+	})
+
+	It("loads one network status entry per sandbox interface", func() {
+		result := &current.Result{
+			CNIVersion: "0.3.1",
+			Interfaces: []*current.Interface{
+				{Name: "cni0", Mac: "00:11:22:33:44:55"},
+				{Name: "eth0", Mac: "00:11:22:33:44:66", Sandbox: "/var/run/netns/test"},
+				{Name: "north", Mac: "00:11:22:33:44:77", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{
+				{Version: "4", Interface: current.Int(1), Address: *testhelpers.EnsureCIDR("10.0.0.5/24"), Gateway: net.ParseIP("10.0.0.1")},
+				{Version: "4", Interface: current.Int(2), Address: *testhelpers.EnsureCIDR("192.168.0.5/16")},
+				{Version: "6", Address: *testhelpers.EnsureCIDR("fd00::5/64")},
+			},
+			Routes: []*cnitypes.Route{
+				{Dst: *testhelpers.EnsureCIDR("0.0.0.0/0"), GW: net.ParseIP("10.0.0.1")},
+				{Dst: *testhelpers.EnsureCIDR("172.16.0.0/12"), GW: net.ParseIP("192.168.0.1")},
+			},
+		}
+
+		netStatus, err := LoadNetworkStatus(result, "net1", "north", true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netStatus).To(HaveLen(2))
+
+		Expect(netStatus[0].Name).To(Equal("net1"))
+		Expect(netStatus[0].Interface).To(Equal("eth0"))
+		Expect(netStatus[0].Mac).To(Equal("00:11:22:33:44:66"))
+		Expect(netStatus[0].Default).To(BeFalse())
+		Expect(netStatus[0].IPs).To(Equal([]string{"10.0.0.5", "fd00::5"}))
+		Expect(netStatus[0].CIDRs).To(Equal([]string{"10.0.0.5/24", "fd00::5/64"}))
+		Expect(netStatus[0].Gateways).To(Equal([]string{"10.0.0.1"}))
+		Expect(netStatus[0].Routes).To(HaveLen(1))
+		Expect(netStatus[0].Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+
+		Expect(netStatus[1].Interface).To(Equal("north"))
+		Expect(netStatus[1].Default).To(BeTrue())
+		Expect(netStatus[1].CIDRs).To(Equal([]string{"192.168.0.5/16"}))
+		Expect(netStatus[1].Gateways).To(BeEmpty())
+		Expect(netStatus[1].Routes).To(HaveLen(1))
+		Expect(netStatus[1].Routes[0].Dst.String()).To(Equal("172.16.0.0/12"))
+	})
+
+	It("defaults and checks the kube client settings", func() {
+		netConf, err := LoadNetConf([]byte(`{
+    "name": "node-cni-network",
+    "type": "multus",
+    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+    "kubeQPS": 20,
+    "kubeProtobuf": true
+}`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.KubeTimeout).To(Equal(defaultKubeTimeout))
+		Expect(netConf.KubeQPS).To(BeEquivalentTo(20))
+		Expect(netConf.KubeBurst).To(Equal(0))
+		Expect(netConf.KubeProtobuf).To(BeTrue())
+
+		_, err = LoadNetConf([]byte(`{
+    "name": "node-cni-network",
+    "type": "multus",
+    "kubeTimeout": -1
+}`), false)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps the plugin version cache in the cniDir", func() {
+		netConf, err := LoadNetConf([]byte(`{
+    "name": "node-cni-network",
+    "type": "multus",
+    "cniDir": "/var/lib/cni/networks/test"
+}`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.VersionCacheFile).To(Equal("/var/lib/cni/networks/test/.plugin-versions.json"))
+
+		netConf, err = LoadNetConf([]byte(`{
+    "name": "node-cni-network",
+    "type": "multus"
+}`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.VersionCacheFile).To(Equal(filepath.Join(defaultCNIDir, ".plugin-versions.json")))
+
+		netConf, err = LoadNetConf([]byte(`{
+    "name": "node-cni-network",
+    "type": "multus",
+    "versionCacheFile": "/run/multus/plugin-versions.json"
+}`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.VersionCacheFile).To(Equal("/run/multus/plugin-versions.json"))
+	})
+
+	It("fails if an inline delegate has no type", func() {
 		conf := `{
     "name": "node-cni-network",
     "type": "multus",
-    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml"
+    "delegates": [{
+        "name": "weave1"
+    }]
+}`
+		_, err := LoadNetConf([]byte(conf), false)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails if inline delegates share the same name", func() {
+		conf := `{
+    "name": "node-cni-network",
+    "type": "multus",
+    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+    "delegates": [{
+        "name": "weave1",
+        "type": "weave-net"
+    },{
+        "name": "weave1",
+        "type": "foobar"
+    }]
 }`
 		_, err := LoadNetConf([]byte(conf), false)
 		Expect(err).To(HaveOccurred())
@@ -0,0 +1,213 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+	mtypes "github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
+// versionCacheFile is the default version cache in the cniDir, hidden from
+// the store
+const versionCacheFile = ".plugin-versions.json"
+
+// pluginVersions is the cached VERSION output of one plugin binary, it is
+// only valid as long as the binary is not replaced
+type pluginVersions struct {
+	ModTime  int64    `json:"modTime"`
+	Versions []string `json:"versions"`
+}
+
+// versionCache maps plugin binary paths to their supported CNI versions
+type versionCache struct {
+	file    string
+	entries map[string]*pluginVersions
+	dirty   bool
+}
+
+func loadVersionCache(file string) *versionCache {
+	c := &versionCache{
+		file:    file,
+		entries: make(map[string]*pluginVersions),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Errorf("loadVersionCache: failed to read %s, ignore it: %v", file, err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		logging.Errorf("loadVersionCache: failed to parse %s, ignore it: %v", file, err)
+		c.entries = make(map[string]*pluginVersions)
+	}
+	return c
+}
+
+func (c *versionCache) get(pluginPath string, modTime int64) ([]string, bool) {
+	entry, ok := c.entries[pluginPath]
+	if !ok || entry.ModTime != modTime {
+		return nil, false
+	}
+	return entry.Versions, true
+}
+
+func (c *versionCache) set(pluginPath string, modTime int64, versions []string) {
+	c.entries[pluginPath] = &pluginVersions{ModTime: modTime, Versions: versions}
+	c.dirty = true
+}
+
+// save writes the cache through a temp file, so that concurrent multus
+// invocations never read a partially written cache
+func (c *versionCache) save() error {
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.file), filepath.Base(c.file))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), c.file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// getPluginVersions returns the CNI versions supported by the plugin binary,
+// running its VERSION command only if the binary is not in the cache yet
+func getPluginVersions(pluginType string, binDirs []string, exec invoke.Exec, cache *versionCache) ([]string, error) {
+	var pluginPath string
+	var err error
+	if exec == nil {
+		pluginPath, err = invoke.FindInPath(pluginType, binDirs)
+	} else {
+		pluginPath, err = exec.FindInPath(pluginType, binDirs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// plugins which can't be stat'ed, e.g. faked in tests, are never cached
+	var modTime int64
+	if info, err := os.Stat(pluginPath); err == nil {
+		modTime = info.ModTime().UnixNano()
+		if versions, ok := cache.get(pluginPath, modTime); ok {
+			return versions, nil
+		}
+	}
+
+	pluginInfo, err := invoke.GetVersionInfo(pluginPath, exec)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := pluginInfo.SupportedVersions()
+	if modTime != 0 {
+		cache.set(pluginPath, modTime, versions)
+	}
+	logging.Debugf("getPluginVersions: %s supports %v", pluginPath, versions)
+	return versions, nil
+}
+
+// DelegateVersion returns the cniVersion of the delegate conf or conflist
+func DelegateVersion(delegate *mtypes.DelegateNetConf) string {
+	confVersion := delegate.Conf.CNIVersion
+	if delegate.ConfListPlugin {
+		confVersion = delegate.ConfList.CNIVersion
+	}
+	if confVersion == "" {
+		// same as version.ConfigDecoder
+		confVersion = "0.1.0"
+	}
+	return confVersion
+}
+
+// CheckDelegateVersions makes sure every plugin of every delegate supports the
+// cniVersion of its conf, and that multus understands that version as well.
+// All incompatibilities are reported together.
+func CheckDelegateVersions(delegates []*mtypes.DelegateNetConf, binDir string, exec invoke.Exec, cacheFile string) error {
+	logging.Debugf("CheckDelegateVersions: %v, %s, %s", delegates, binDir, cacheFile)
+	binDirs := GetBinDirs(binDir)
+	cache := loadVersionCache(cacheFile)
+	reconciler := &version.Reconciler{}
+
+	var errstr []string
+	for _, delegate := range delegates {
+		confVersion := DelegateVersion(delegate)
+		pluginTypes := []string{delegate.Conf.Type}
+		if delegate.ConfListPlugin {
+			pluginTypes = nil
+			for _, plugin := range delegate.ConfList.Plugins {
+				pluginTypes = append(pluginTypes, plugin.Type)
+			}
+		}
+
+		if err := reconciler.Check(confVersion, version.All); err != nil {
+			errstr = append(errstr, fmt.Sprintf("network %s: multus does not support it: %v", delegate.Name(), err))
+			continue
+		}
+
+		for _, pluginType := range pluginTypes {
+			versions, err := getPluginVersions(pluginType, binDirs, exec, cache)
+			if err != nil {
+				errstr = append(errstr, fmt.Sprintf("network %s: failed to get version info of plugin %s: %v", delegate.Name(), pluginType, err))
+				continue
+			}
+			if err := reconciler.CheckRaw(confVersion, versions); err != nil {
+				errstr = append(errstr, fmt.Sprintf("network %s: plugin %s: %v", delegate.Name(), pluginType, err))
+			}
+		}
+	}
+
+	if err := cache.save(); err != nil {
+		// ignore error, the cache only saves VERSION calls
+		logging.Errorf("CheckDelegateVersions: failed to save version cache %s: %v", cacheFile, err)
+	}
+
+	if len(errstr) > 0 {
+		return logging.Errorf("CheckDelegateVersions: %s", strings.Join(errstr, "; "))
+	}
+	return nil
+}
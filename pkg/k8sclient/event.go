@@ -0,0 +1,201 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
+// Reasons of the events multus posts on the pod
+const (
+	EventReasonAttached     = "AttachedNetwork"
+	EventReasonAttachFailed = "FailedAttachNetwork"
+	EventReasonDetached     = "DetachedNetworks"
+	EventReasonDetachFailed = "FailedDetachNetworks"
+	eventSourceComponent    = "multus"
+	maxEventMessageLen      = 1024
+
+	// a pod may post eventBurst events of a reason at once and one more every
+	// eventInterval, events over the limit are dropped
+	eventBurst    = 10
+	eventInterval = time.Minute
+	// the buckets are hidden in the cniDir, the store skips them
+	eventDirName = ".events"
+)
+
+// eventBucket is the token bucket of the events of a pod and reason. Every
+// CNI command is a multus process of its own, so the bucket is kept in a file
+// to hold across the commands of the pod.
+type eventBucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// eventDir returns the directory of the event buckets, events are not limited
+// without a cniDir
+func eventDir(netConf *types.NetConf) string {
+	if netConf.CNIDir == "" {
+		return ""
+	}
+	return filepath.Join(netConf.CNIDir, eventDirName)
+}
+
+// acceptEvent takes a token from the bucket of the pod and reason in dir. The
+// event is accepted if the bucket can not be read, events are best effort
+// but must not get lost because of a broken bucket.
+func acceptEvent(dir, namespace, name, reason string, now time.Time) bool {
+	if dir == "" {
+		return true
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logging.Errorf("acceptEvent: failed to create %s: %v", dir, err)
+		return true
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s_%s", namespace, name, reason))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logging.Errorf("acceptEvent: failed to open %s: %v", path, err)
+		return true
+	}
+	defer f.Close()
+	// the commands of a pod may run concurrently, the lock is released with
+	// the file
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		logging.Errorf("acceptEvent: failed to lock %s: %v", path, err)
+		return true
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		logging.Errorf("acceptEvent: failed to read %s: %v", path, err)
+		return true
+	}
+	bucket := &eventBucket{Tokens: eventBurst, Last: now}
+	if len(data) == 0 {
+		pruneEventBuckets(dir, now)
+	} else if err := json.Unmarshal(data, bucket); err != nil {
+		logging.Errorf("acceptEvent: reset corrupt bucket %s: %v", path, err)
+		bucket = &eventBucket{Tokens: eventBurst, Last: now}
+	}
+
+	if elapsed := now.Sub(bucket.Last); elapsed > 0 {
+		bucket.Tokens += float64(elapsed) / float64(eventInterval)
+	}
+	if bucket.Tokens > eventBurst {
+		bucket.Tokens = eventBurst
+	}
+	bucket.Last = now
+	accepted := bucket.Tokens >= 1
+	if accepted {
+		bucket.Tokens--
+	}
+
+	if data, err = json.Marshal(bucket); err == nil {
+		if err = f.Truncate(0); err == nil {
+			_, err = f.WriteAt(data, 0)
+		}
+	}
+	if err != nil {
+		logging.Errorf("acceptEvent: failed to save %s: %v", path, err)
+	}
+	return accepted
+}
+
+// pruneEventBuckets removes the buckets which refilled since their last use,
+// a missing bucket is full as well
+func pruneEventBuckets(dir string, now time.Time) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logging.Errorf("pruneEventBuckets: failed to read %s: %v", dir, err)
+		return
+	}
+	for _, file := range files {
+		if now.Sub(file.ModTime()) < eventBurst*eventInterval {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			logging.Errorf("pruneEventBuckets: failed to remove %s: %v", file.Name(), err)
+		}
+	}
+}
+
+// RecordPodEvent posts an event on the pod. Events are best effort, errors
+// are only logged and never fail the CNI command.
+func RecordPodEvent(k *clientInfo, eventType, reason, message string) {
+	if k == nil {
+		return
+	}
+
+	if !acceptEvent(k.EventDir, k.Podnamespace, k.Podname, reason, time.Now()) {
+		logging.Infof("RecordPodEvent: rate limited, drop event %s for pod %s/%s: %s", reason, k.Podnamespace, k.Podname, message)
+		return
+	}
+
+	if k.PodUID == "" {
+		pod, err := k.Client.GetPod(k.Podnamespace, k.Podname)
+		if err != nil {
+			logging.Errorf("RecordPodEvent: failed to query the pod %s/%s, drop event %s: %v", k.Podnamespace, k.Podname, reason, err)
+			return
+		}
+		k.PodUID = pod.UID
+	}
+
+	if len(message) > maxEventMessageLen {
+		message = message[:maxEventMessageLen-3] + "..."
+	}
+
+	host, _ := os.Hostname()
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", k.Podname, now.UnixNano()),
+			Namespace: k.Podnamespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  k.Podnamespace,
+			Name:       k.Podname,
+			UID:        k.PodUID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source: v1.EventSource{
+			Component: eventSourceComponent,
+			Host:      host,
+		},
+	}
+
+	if _, err := k.Client.CreateEvent(event); err != nil {
+		logging.Errorf("RecordPodEvent: failed to create event %s for pod %s/%s: %v", reason, k.Podnamespace, k.Podname, err)
+	}
+}
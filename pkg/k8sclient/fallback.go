@@ -0,0 +1,129 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/conf"
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
+// annotationCacheTTL is how long the last seen annotation of a pod is kept,
+// entries are refreshed whenever a sandbox of the pod is added
+const annotationCacheTTL = 30 * 24 * time.Hour
+
+// ApiserverUnavailableError indicates the pod could not be fetched because
+// the apiserver is unreachable or overloaded
+type ApiserverUnavailableError struct {
+	err error
+}
+
+func (e *ApiserverUnavailableError) Error() string {
+	return "apiserver is unavailable: " + e.err.Error()
+}
+
+// saveAnnotationCache keeps the network annotation of the pod, an empty
+// annotation is kept as well, the pod uses the default delegates then
+func saveAnnotationCache(dir string, uid k8stypes.UID, annotation string) error {
+	if uid == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	pruneAnnotationCache(dir)
+
+	f, err := ioutil.TempFile(dir, ".tmp-"+string(uid))
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(annotation); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, string(uid))); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func loadAnnotationCache(dir string, uid k8stypes.UID) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, string(uid)))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// pruneAnnotationCache removes the entries of pods not seen for a long time
+func pruneAnnotationCache(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logging.Errorf("pruneAnnotationCache: failed to read %s: %v", dir, err)
+		return
+	}
+	for _, file := range files {
+		if time.Since(file.ModTime()) < annotationCacheTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			logging.Errorf("pruneAnnotationCache: failed to remove %s: %v", file.Name(), err)
+		}
+	}
+}
+
+// getFallbackDelegates selects the pod networks by the apiserver fallback
+// policy of the multus config, the policy used is recorded in clientInfo
+func getFallbackDelegates(k *clientInfo, k8sArgs *types.K8sArgs, netConf *types.NetConf, apiErr error) ([]*types.DelegateNetConf, error) {
+	switch netConf.ApiserverFallback {
+	case types.ApiserverFallbackDefaultDelegates:
+		if netConf.DefaultDelegates == "" {
+			return nil, logging.Errorf("getFallbackDelegates: %v, and defaultDelegates is empty", apiErr)
+		}
+		logging.Infof("getFallbackDelegates: %v, use default delegates %s for pod %s/%s", apiErr, netConf.DefaultDelegates, k.Podnamespace, k.Podname)
+		k.Fallback = types.ApiserverFallbackDefaultDelegates
+		return conf.GetDefaultDelegates(netConf)
+	case types.ApiserverFallbackCache:
+		uid := k8stypes.UID(k8sArgs.K8S_POD_UID)
+		if uid == "" {
+			return nil, logging.Errorf("getFallbackDelegates: %v, and no K8S_POD_UID to look up the annotation cache", apiErr)
+		}
+		annotation, err := loadAnnotationCache(netConf.AnnotationCacheDir, uid)
+		if err != nil {
+			return nil, logging.Errorf("getFallbackDelegates: %v, and failed to load the annotation cache of pod %s: %v", apiErr, uid, err)
+		}
+		logging.Infof("getFallbackDelegates: %v, use cached annotation %q for pod %s/%s(%s)", apiErr, annotation, k.Podnamespace, k.Podname, uid)
+		k.Fallback = types.ApiserverFallbackCache
+		if annotation == "" {
+			return nil, &NoK8sNetworkError{"no kubernetes network found in annotation cache"}
+		}
+		return getK8sNetworkFromAnnotation(k.Client, annotation, k.Podnamespace, netConf)
+	default:
+		return nil, logging.Errorf("getFallbackDelegates: %v, apiserverFallback is %s", apiErr, netConf.ApiserverFallback)
+	}
+}
@@ -19,13 +19,16 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/retry"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
@@ -51,6 +54,13 @@ type clientInfo struct {
 	Client       KubeClient
 	Podnamespace string
 	Podname      string
+	// PodUID comes from K8S_POD_UID or is known once the pod was fetched,
+	// status patches are rejected if the pod was recreated since
+	PodUID k8stypes.UID
+	// Fallback is the apiserver fallback policy used to select the networks
+	Fallback string
+	// EventDir keeps the rate limits of the events of the pod
+	EventDir string
 }
 
 func (e *NoK8sNetworkError) Error() string { return string(e.message) }
@@ -70,22 +80,28 @@ func (d *defaultKubeClient) UpdatePodStatus(pod *v1.Pod) (*v1.Pod, error) {
 	return d.client.CoreV1().Pods(pod.Namespace).UpdateStatus(pod)
 }
 
-func setKubeClientInfo(c *clientInfo, client KubeClient, k8sArgs *types.K8sArgs) {
+func (d *defaultKubeClient) PatchPodStatus(namespace, name string, pt k8stypes.PatchType, data []byte) (*v1.Pod, error) {
+	return d.client.CoreV1().Pods(namespace).Patch(name, pt, data, "status")
+}
+
+func (d *defaultKubeClient) CreateEvent(event *v1.Event) (*v1.Event, error) {
+	return d.client.CoreV1().Events(event.Namespace).Create(event)
+}
+
+func setKubeClientInfo(c *clientInfo, client KubeClient, k8sArgs *types.K8sArgs, netConf *types.NetConf) {
 	c.Client = client
 	c.Podnamespace = string(k8sArgs.K8S_POD_NAMESPACE)
 	c.Podname = string(k8sArgs.K8S_POD_NAME)
+	c.PodUID = k8stypes.UID(k8sArgs.K8S_POD_UID)
+	c.EventDir = eventDir(netConf)
 }
 
 func SetNetworkStatus(k *clientInfo, netStatus []*types.NetworkStatus) error {
-	pod, err := k.Client.GetPod(k.Podnamespace, k.Podname)
-	if err != nil {
-		return logging.Errorf("SetNetworkStatus: failed to query the pod %s in out of cluster comm: %v", k.Podname, err)
-	}
-
 	var ns string
 	if netStatus != nil {
 		var networkStatus []string
 		for _, nets := range netStatus {
+			nets.Fallback = k.Fallback
 			data, err := json.MarshalIndent(nets, "", "    ")
 			if err != nil {
 				return logging.Errorf("SetNetworkStatus: error with Marshal Indent: %v", err)
@@ -95,58 +111,144 @@ func SetNetworkStatus(k *clientInfo, netStatus []*types.NetworkStatus) error {
 
 		ns = fmt.Sprintf("[%s]", strings.Join(networkStatus, ","))
 	}
-	_, err = setPodNetworkAnnotation(k.Client, k.Podnamespace, pod, ns)
+	pod, err := setPodNetworkAnnotation(k.Client, k.Podnamespace, k.Podname, k.PodUID, ns)
 	if err != nil {
 		return logging.Errorf("SetNetworkStatus: failed to update the pod %s in out of cluster comm: %v", k.Podname, err)
 	}
+	k.PodUID = pod.UID
 
 	return nil
 }
 
-func setPodNetworkAnnotation(client KubeClient, namespace string, pod *v1.Pod, networkstatus string) (*v1.Pod, error) {
-	logging.Infof("setPodNetworkAnnotation: %s/%s, %s", namespace, pod.Name, networkstatus)
-	//if pod annotations is empty, make sure it allocatable
-	if len(pod.Annotations) == 0 {
-		pod.Annotations = make(map[string]string)
+// patchBackoff bounds the time spent on patching the status annotation, the
+// cni command must return to kubelet in time
+var patchBackoff = wait.Backoff{
+	Steps:    4,
+	Duration: 100 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// isTransientError reports whether a request to the apiserver may succeed if
+// retried. Errors which are not api status errors come from the transport.
+func isTransientError(err error) bool {
+	if _, ok := err.(errors.APIStatus); !ok {
+		return true
+	}
+	return errors.IsServerTimeout(err) || errors.IsTimeout(err) || errors.IsTooManyRequests(err) ||
+		errors.IsInternalError(err) || errors.IsServiceUnavailable(err)
+}
+
+// setPodNetworkAnnotation merge patches the networks-status annotation of the
+// pod status, so no other field of the pod is touched and there is nothing to
+// conflict with kubelet's own status updates
+func setPodNetworkAnnotation(client KubeClient, namespace, name string, uid k8stypes.UID, networkstatus string) (*v1.Pod, error) {
+	logging.Infof("setPodNetworkAnnotation: %s/%s(%s), %s", namespace, name, uid, networkstatus)
+	metadata := map[string]interface{}{
+		"annotations": map[string]string{
+			CNINetworksStatusAnnotation: networkstatus,
+		},
 	}
+	if uid != "" {
+		// the apiserver takes the uid as a precondition of the patch
+		metadata["uid"] = uid
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return nil, err
+	}
+
+	var pod *v1.Pod
+	var lastErr error
+	if resultErr := wait.ExponentialBackoff(patchBackoff, func() (bool, error) {
+		pod, lastErr = client.PatchPodStatus(namespace, name, k8stypes.MergePatchType, patch)
+		if lastErr == nil {
+			return true, nil
+		}
+		if !isTransientError(lastErr) {
+			return false, lastErr
+		}
+		logging.Debugf("setPodNetworkAnnotation: retry patching pod %s/%s: %v", namespace, name, lastErr)
+		return false, nil
+	}); resultErr != nil {
+		if resultErr == wait.ErrWaitTimeout {
+			resultErr = lastErr
+		}
+		resultErr = explainUnauthorized(resultErr)
+		return nil, logging.Errorf("status patch failed for pod %s/%s: %v", namespace, name, resultErr)
+	}
+	return pod, nil
+}
 
-	pod.Annotations[CNINetworksStatusAnnotation] = networkstatus
+// getPodBackoff bounds the pod GETs, both the retries on transient errors and
+// the retries while the apiserver still returns the old incarnation of a
+// recreated pod count against it
+var getPodBackoff = wait.Backoff{
+	Steps:    3,
+	Duration: 200 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
 
-	pod = pod.DeepCopy()
+// getPod fetches the pod, if uid is not empty the pod must be that
+// incarnation. Transient errors are returned as ApiserverUnavailableError
+// once the retries are exhausted.
+func getPod(client KubeClient, namespace, name string, uid k8stypes.UID) (*v1.Pod, error) {
+	var pod *v1.Pod
 	var err error
-	if resultErr := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+	if waitErr := wait.ExponentialBackoff(getPodBackoff, func() (bool, error) {
+		pod, err = client.GetPod(namespace, name)
+		if apiserver := apiserverClient(client); err == nil && uid != "" && pod.UID != uid && apiserver != client {
+			// the pod cache may lag behind the recreated pod
+			logging.Debugf("getPod: cached pod %s/%s has UID %s, expect %s, get it from apiserver", namespace, name, pod.UID, uid)
+			client = apiserver
+			pod, err = client.GetPod(namespace, name)
+		}
 		if err != nil {
-			// Re-get the pod unless it's the first attempt to update
-			pod, err = client.GetPod(pod.Namespace, pod.Name)
-			if err != nil {
-				return err
+			if !isTransientError(err) {
+				return false, err
 			}
+			logging.Debugf("getPod: retry getting pod %s/%s: %v", namespace, name, err)
+			return false, nil
 		}
-
-		pod, err = client.UpdatePodStatus(pod)
-		return err
-	}); resultErr != nil {
-		return nil, logging.Errorf("status update failed for pod %s/%s: %v", pod.Namespace, pod.Name, resultErr)
+		if uid == "" || pod.UID == uid {
+			return true, nil
+		}
+		logging.Debugf("getPod: pod %s/%s has UID %s, expect %s, retry", namespace, name, pod.UID, uid)
+		return false, nil
+	}); waitErr != nil {
+		if waitErr != wait.ErrWaitTimeout {
+			return nil, explainUnauthorized(waitErr)
+		}
+		if err != nil {
+			return nil, &ApiserverUnavailableError{err}
+		}
+		return nil, fmt.Errorf("pod %s/%s UID mismatch: expect %s, got %s", namespace, name, uid, pod.UID)
 	}
 	return pod, nil
 }
 
-func getPodNetworkAnnotation(client KubeClient, k8sArgs *types.K8sArgs) (string, string, error) {
+func getPodNetworkAnnotation(client KubeClient, k8sArgs *types.K8sArgs) (*v1.Pod, error) {
 	var err error
 
-	pod, err := client.GetPod(string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+	pod, err := getPod(client, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), k8stypes.UID(k8sArgs.K8S_POD_UID))
 	if err != nil {
-		return "", "", logging.Errorf("getPodNetworkAnnotation: failed to query the pod %v in out of cluster comm: %v", string(k8sArgs.K8S_POD_NAME), err)
+		if _, ok := err.(*ApiserverUnavailableError); ok {
+			// keep the error type, the caller may fall back
+			logging.Errorf("getPodNetworkAnnotation: failed to query the pod %v: %v", string(k8sArgs.K8S_POD_NAME), err)
+			return nil, err
+		}
+		return nil, logging.Errorf("getPodNetworkAnnotation: failed to query the pod %v in out of cluster comm: %v", string(k8sArgs.K8S_POD_NAME), err)
 	}
 
 	logging.Infof("getPodNetworkAnnotation: %s/%s, %s", pod.Namespace, pod.Name, pod.Annotations[CNINetworksAnnotation])
 
-	return pod.Annotations[CNINetworksAnnotation], pod.ObjectMeta.Namespace, nil
+	return pod, nil
 }
 
-func getKubernetesDelegate(client KubeClient, net *types.NetworkSelectionElement, confdir string) (*types.DelegateNetConf, error) {
-	logging.Debugf("getKubernetesDelegate: %+v, %s", net, confdir)
-	delegate, err := conf.GetDelegateFromFile(net, confdir)
+func getKubernetesDelegate(client KubeClient, net *types.NetworkSelectionElement, netConf *types.NetConf) (*types.DelegateNetConf, error) {
+	logging.Debugf("getKubernetesDelegate: %+v, %s", net, netConf.ConfDir)
+	delegate, err := conf.GetDelegate(net, netConf)
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +259,8 @@ func getKubernetesDelegate(client KubeClient, net *types.NetworkSelectionElement
 type KubeClient interface {
 	GetPod(namespace, name string) (*v1.Pod, error)
 	UpdatePodStatus(pod *v1.Pod) (*v1.Pod, error)
+	PatchPodStatus(namespace, name string, pt k8stypes.PatchType, data []byte) (*v1.Pod, error)
+	CreateEvent(event *v1.Event) (*v1.Event, error)
 }
 
 func GetK8sArgs(args *skel.CmdArgs) (*types.K8sArgs, error) {
@@ -178,12 +282,23 @@ func TryLoadK8sDelegates(k8sArgs *types.K8sArgs, netConf *types.NetConf, kubeCli
 	clientInfo := &clientInfo{}
 
 	logging.Debugf("TryLoadK8sDelegates: %v, %v, %v", k8sArgs, netConf, kubeClient)
-	kubeClient, err = GetK8sClient(netConf.Kubeconfig, kubeClient)
+	kubeClient, err = GetK8sClient(netConf, kubeClient)
 	if err != nil {
 		return 0, nil, err
 	}
 
 	if kubeClient == nil {
+		if len(netConf.Delegates) == 0 && netConf.DefaultDelegates != "" {
+			// No available kube client, the default delegates are all we have
+			delegates, err := conf.GetDefaultDelegates(netConf)
+			if err != nil {
+				return 0, nil, logging.Errorf("failed to load default delegates from config: %v", err)
+			}
+			if err = netConf.SetDelegates(delegates); err != nil {
+				return 0, nil, err
+			}
+			netConf.Delegates[0].MasterPlugin = true
+		}
 		if len(netConf.Delegates) == 0 {
 			// No available kube client and no delegates, we can't do anything
 			return 0, nil, logging.Errorf("must have either Kubernetes config or delegates, refer Multus README.md for the usage guide")
@@ -191,8 +306,20 @@ func TryLoadK8sDelegates(k8sArgs *types.K8sArgs, netConf *types.NetConf, kubeCli
 		return 0, nil, nil
 	}
 
-	setKubeClientInfo(clientInfo, kubeClient, k8sArgs)
-	delegates, err := GetK8sNetwork(kubeClient, k8sArgs, netConf.ConfDir)
+	setKubeClientInfo(clientInfo, kubeClient, k8sArgs, netConf)
+	delegates, pod, err := getK8sNetwork(kubeClient, k8sArgs, netConf)
+	if pod != nil {
+		clientInfo.PodUID = pod.UID
+		if netConf.ApiserverFallback == types.ApiserverFallbackCache {
+			if err := saveAnnotationCache(netConf.AnnotationCacheDir, pod.UID, pod.Annotations[CNINetworksAnnotation]); err != nil {
+				// ignore error, the cache is only used during apiserver outages
+				logging.Errorf("TryLoadK8sDelegates: failed to save the annotation cache of pod %s: %v", pod.UID, err)
+			}
+		}
+	}
+	if apiErr, ok := err.(*ApiserverUnavailableError); ok {
+		delegates, err = getFallbackDelegates(clientInfo, k8sArgs, netConf, apiErr)
+	}
 	if err != nil {
 		if _, ok := err.(*NoK8sNetworkError); !ok {
 			return 0, nil, logging.Errorf("TryLoadK8sDelegates: Err in getting k8s network from pod: %v", err)
@@ -203,7 +330,7 @@ func TryLoadK8sDelegates(k8sArgs *types.K8sArgs, netConf *types.NetConf, kubeCli
 			return 0, clientInfo, nil
 		}
 		logging.Infof("Not found network from annotations, try to get default delegates %v. K8sArgs: %v", netConf.DefaultDelegates, k8sArgs)
-		delegates, err = conf.GetDefaultDelegates(netConf.DefaultDelegates, netConf.ConfDir)
+		delegates, err = conf.GetDefaultDelegates(netConf)
 		if err != nil {
 			return 0, nil, logging.Errorf("failed to load default delegates from config: %v", err)
 		}
@@ -218,17 +345,94 @@ func TryLoadK8sDelegates(k8sArgs *types.K8sArgs, netConf *types.NetConf, kubeCli
 	return len(delegates), clientInfo, nil
 }
 
-func GetK8sClient(kubeconfig string, kubeClient KubeClient) (KubeClient, error) {
+// TryLoadDelDelegates rebuilds the delegates for a DEL whose delegates are
+// lost. If the pod still exists they are loaded like for the ADD, otherwise
+// they are the delOnlyDelegates of the multus config.
+func TryLoadDelDelegates(k8sArgs *types.K8sArgs, netConf *types.NetConf, kubeClient KubeClient) (int, *clientInfo, error) {
+	kubeClient, err := GetK8sClient(netConf, kubeClient)
+	if err != nil {
+		return 0, nil, err
+	}
+	if kubeClient == nil {
+		// the ADD did not know the pod either
+		return TryLoadK8sDelegates(k8sArgs, netConf, kubeClient)
+	}
+
+	namespace, name, uid := string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), k8stypes.UID(k8sArgs.K8S_POD_UID)
+	pod, err := getPod(kubeClient, namespace, name, "")
+	switch {
+	case err == nil && (uid == "" || pod.UID == uid):
+		return TryLoadK8sDelegates(k8sArgs, netConf, kubeClient)
+	case err == nil:
+		logging.Infof("TryLoadDelDelegates: pod %s/%s is recreated with UID %s, expect %s", namespace, name, pod.UID, uid)
+	case errors.IsNotFound(err):
+		logging.Infof("TryLoadDelDelegates: pod %s/%s is gone", namespace, name)
+	default:
+		return 0, nil, logging.Errorf("TryLoadDelDelegates: failed to query the pod %s/%s: %v", namespace, name, err)
+	}
+
+	delegates, err := conf.GetDelOnlyDelegates(netConf)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(delegates) == 0 {
+		return 0, nil, nil
+	}
+	if err = netConf.SetDelegates(delegates); err != nil {
+		return 0, nil, err
+	}
+	netConf.Delegates[0].MasterPlugin = true
+	return len(delegates), nil, nil
+}
+
+// GetClientInfo returns the kube client info of the pod without loading any
+// delegate, it is nil if multus does not talk to kubernetes
+func GetClientInfo(k8sArgs *types.K8sArgs, netConf *types.NetConf, kubeClient KubeClient) (*clientInfo, error) {
+	kubeClient, err := GetK8sClient(netConf, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	if kubeClient == nil {
+		return nil, nil
+	}
+
+	clientInfo := &clientInfo{}
+	setKubeClientInfo(clientInfo, kubeClient, k8sArgs, netConf)
+	return clientInfo, nil
+}
+
+// GetK8sClient returns the kube client set up by the kubeconfig and the kube
+// client settings of the multus config. Pods are read from the pod cache
+// daemon first if podCacheSocket is set.
+func GetK8sClient(netConf *types.NetConf, kubeClient KubeClient) (KubeClient, error) {
 	// If we get a valid kubeClient (eg from testcases) just return that
 	// one.
 	if kubeClient != nil {
 		return kubeClient, nil
 	}
 
+	client, err := GetK8sClientset(netConf)
+	if err != nil || client == nil {
+		return nil, err
+	}
+
+	kubeClient = &defaultKubeClient{client: client}
+	if netConf.PodCacheSocket != "" {
+		kubeClient = newPodCacheClient(netConf.PodCacheSocket, kubeClient)
+	}
+	return kubeClient, nil
+}
+
+// GetK8sClientset returns the clientset set up by the kubeconfig and the kube
+// client settings of the multus config, it is nil if there is no kubeconfig
+// and multus does not run in a pod
+func GetK8sClientset(netConf *types.NetConf) (kubernetes.Interface, error) {
 	var err error
 	var config *rest.Config
+	inCluster := false
 
 	// Otherwise try to create a kubeClient from a given kubeConfig
+	kubeconfig := netConf.Kubeconfig
 	if kubeconfig != "" {
 		// uses the current context in kubeconfig
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
@@ -241,33 +445,72 @@ func GetK8sClient(kubeconfig string, kubeClient KubeClient) (KubeClient, error)
 		if err != nil {
 			return nil, logging.Errorf("createK8sClient: failed to get context for in-cluster kube config, refer Multus README.md for the usage guide: %v", err)
 		}
+		inCluster = true
 	} else {
 		// No kubernetes config; assume we shouldn't talk to Kube at all
 		return nil, nil
 	}
 
-	// creates the clientset
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
+	tokenSource := kubeconfig
+	if tokenSource == "" {
+		tokenSource = "the in-cluster config"
+	}
+	if netConf.TokenFile != "" {
+		token, err := loadToken(netConf.TokenFile)
+		if err != nil {
+			return nil, logging.Errorf("GetK8sClient: %v", err)
+		}
+		config.BearerToken = token
+		if inCluster {
+			// the in-cluster config wraps its own token source, which would
+			// override the token of the token file
+			config.WrapTransport = nil
+		}
+		tokenSource = netConf.TokenFile
+	}
+	if config.BearerToken != "" {
+		if err := checkTokenExpiry(config.BearerToken, tokenSource); err != nil {
+			return nil, logging.Errorf("GetK8sClient: %v", err)
+		}
 	}
 
-	return &defaultKubeClient{client: client}, nil
+	config.Timeout = time.Duration(netConf.KubeTimeout) * time.Second
+	config.QPS = netConf.KubeQPS
+	config.Burst = netConf.KubeBurst
+	if netConf.KubeProtobuf {
+		config.ContentType = "application/vnd.kubernetes.protobuf"
+		config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+	}
+
+	// creates the clientset
+	return kubernetes.NewForConfig(config)
 }
 
-func GetK8sNetwork(k8sclient KubeClient, k8sArgs *types.K8sArgs, confdir string) ([]*types.DelegateNetConf, error) {
-	logging.Debugf("GetK8sNetwork: %v, %v, %v", k8sclient, k8sArgs, confdir)
+func GetK8sNetwork(k8sclient KubeClient, k8sArgs *types.K8sArgs, netConf *types.NetConf) ([]*types.DelegateNetConf, error) {
+	delegates, _, err := getK8sNetwork(k8sclient, k8sArgs, netConf)
+	return delegates, err
+}
+
+// getK8sNetwork also returns the pod, once it has been fetched
+func getK8sNetwork(k8sclient KubeClient, k8sArgs *types.K8sArgs, netConf *types.NetConf) ([]*types.DelegateNetConf, *v1.Pod, error) {
+	logging.Debugf("GetK8sNetwork: %v, %v, %v", k8sclient, k8sArgs, netConf.ConfDir)
 
-	netAnnot, defaultNamespace, err := getPodNetworkAnnotation(k8sclient, k8sArgs)
+	pod, err := getPodNetworkAnnotation(k8sclient, k8sArgs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	netAnnot := pod.Annotations[CNINetworksAnnotation]
 	if len(netAnnot) == 0 {
-		return nil, &NoK8sNetworkError{"no kubernetes network found"}
+		return nil, pod, &NoK8sNetworkError{"no kubernetes network found"}
 	}
 
-	networks, err := utils.ParsePodNetworkAnnotation(netAnnot, defaultNamespace)
+	delegates, err := getK8sNetworkFromAnnotation(k8sclient, netAnnot, pod.ObjectMeta.Namespace, netConf)
+	return delegates, pod, err
+}
+
+func getK8sNetworkFromAnnotation(k8sclient KubeClient, netAnnot, namespace string, netConf *types.NetConf) ([]*types.DelegateNetConf, error) {
+	networks, err := utils.ParsePodNetworkAnnotation(netAnnot, namespace)
 	if err != nil {
 		return nil, err
 	}
@@ -275,7 +518,7 @@ func GetK8sNetwork(k8sclient KubeClient, k8sArgs *types.K8sArgs, confdir string)
 	// Read all network objects referenced by 'networks'
 	var delegates []*types.DelegateNetConf
 	for _, net := range networks {
-		delegate, err := getKubernetesDelegate(k8sclient, net, confdir)
+		delegate, err := getKubernetesDelegate(k8sclient, net, netConf)
 		if err != nil {
 			return nil, logging.Errorf("GetK8sNetwork: failed getting the delegate: %v", err)
 		}
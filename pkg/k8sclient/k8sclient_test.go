@@ -16,7 +16,28 @@
 package k8sclient
 
 import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/conf"
+	"github.com/qyzhaoxun/multus-cni/pkg/podcache"
+	testutils "github.com/qyzhaoxun/multus-cni/pkg/testing"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -272,3 +293,574 @@ var _ = Describe("k8sclient operations", func() {
 	})
 })
 */
+
+var _ = Describe("k8sclient events", func() {
+	var fKubeClient *testutils.FakeKubeClient
+	var kc *clientInfo
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		fakePod := testutils.NewFakePod("testpod", "")
+		fakePod.UID = "testpod-uid"
+		fKubeClient = testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+
+		kc, err = GetClientInfo(&types.K8sArgs{
+			K8S_POD_NAME:      "testpod",
+			K8S_POD_NAMESPACE: "test",
+		}, &types.NetConf{CNIDir: tmpDir}, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("posts an event on the pod", func() {
+		RecordPodEvent(kc, v1.EventTypeNormal, EventReasonAttached, "attached network net1 as net1 with 10.0.0.5")
+		Expect(fKubeClient.Events).To(HaveLen(1))
+		event := fKubeClient.Events[0]
+		Expect(event.Namespace).To(Equal("test"))
+		Expect(event.InvolvedObject.Kind).To(Equal("Pod"))
+		Expect(event.InvolvedObject.Name).To(Equal("testpod"))
+		Expect(string(event.InvolvedObject.UID)).To(Equal("testpod-uid"))
+		Expect(event.Type).To(Equal(v1.EventTypeNormal))
+		Expect(event.Reason).To(Equal(EventReasonAttached))
+		Expect(event.Message).To(Equal("attached network net1 as net1 with 10.0.0.5"))
+	})
+
+	It("truncates long messages", func() {
+		RecordPodEvent(kc, v1.EventTypeWarning, EventReasonAttachFailed, strings.Repeat("x", 2*maxEventMessageLen))
+		Expect(fKubeClient.Events).To(HaveLen(1))
+		Expect(fKubeClient.Events[0].Message).To(HaveLen(maxEventMessageLen))
+	})
+
+	It("drops events over the rate limit", func() {
+		for i := 0; i < 2*eventBurst; i++ {
+			RecordPodEvent(kc, v1.EventTypeWarning, EventReasonAttachFailed, "failed to attach network net1")
+		}
+		Expect(fKubeClient.Events).To(HaveLen(eventBurst))
+
+		// the limit is per reason
+		RecordPodEvent(kc, v1.EventTypeNormal, EventReasonDetached, "detached networks net1")
+		Expect(fKubeClient.Events).To(HaveLen(eventBurst + 1))
+	})
+
+	It("keeps the rate limit across multus invocations", func() {
+		now := time.Now()
+		for i := 0; i < eventBurst; i++ {
+			Expect(acceptEvent(kc.EventDir, "test", "testpod", EventReasonAttachFailed, now)).To(BeTrue())
+		}
+		Expect(acceptEvent(kc.EventDir, "test", "testpod", EventReasonAttachFailed, now)).To(BeFalse())
+		Expect(acceptEvent(kc.EventDir, "test", "testpod", EventReasonAttachFailed, now.Add(eventInterval/2))).To(BeFalse())
+
+		// one token is refilled every interval
+		now = now.Add(eventInterval)
+		Expect(acceptEvent(kc.EventDir, "test", "testpod", EventReasonAttachFailed, now)).To(BeTrue())
+		Expect(acceptEvent(kc.EventDir, "test", "testpod", EventReasonAttachFailed, now)).To(BeFalse())
+
+		// other pods have their own bucket
+		Expect(acceptEvent(kc.EventDir, "test", "testpod2", EventReasonAttachFailed, now)).To(BeTrue())
+	})
+
+	It("does nothing without a kube client", func() {
+		RecordPodEvent(nil, v1.EventTypeNormal, EventReasonDetached, "detached networks net1")
+	})
+})
+
+var _ = Describe("k8sclient network status", func() {
+	var fKubeClient *testutils.FakeKubeClient
+	var kc *clientInfo
+	var backoff wait.Backoff
+	podResource := schema.GroupResource{Resource: "pods"}
+
+	BeforeEach(func() {
+		backoff = patchBackoff
+		patchBackoff.Duration = time.Millisecond
+		fakePod := testutils.NewFakePod("testpod", "net1")
+		fakePod.UID = "testpod-uid"
+		fakePod.Status.Phase = v1.PodPending
+		fKubeClient = testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		kc = &clientInfo{Client: fKubeClient, Podnamespace: "test", Podname: "testpod"}
+	})
+
+	AfterEach(func() {
+		patchBackoff = backoff
+	})
+
+	netStatus := []*types.NetworkStatus{{Name: "net1", Interface: "eth1", IPs: []string{"10.0.0.5"}}}
+
+	It("patches only the status annotation", func() {
+		Expect(SetNetworkStatus(kc, netStatus)).To(Succeed())
+		Expect(fKubeClient.PatchCount).To(Equal(1))
+		Expect(fKubeClient.PodCount).To(Equal(0))
+		Expect(kc.PodUID).To(BeEquivalentTo("testpod-uid"))
+
+		pod, err := fKubeClient.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[CNINetworksAnnotation]).To(Equal("net1"))
+		Expect(pod.Annotations[CNINetworksStatusAnnotation]).To(ContainSubstring(`"interface": "eth1"`))
+		Expect(pod.Status.Phase).To(Equal(v1.PodPending))
+	})
+
+	It("retries transient errors", func() {
+		fKubeClient.PatchErrors = []error{
+			errors.NewServerTimeout(podResource, "patch", 1),
+			errors.NewTooManyRequests("slow down", 1),
+		}
+		Expect(SetNetworkStatus(kc, netStatus)).To(Succeed())
+		Expect(fKubeClient.PatchCount).To(Equal(3))
+	})
+
+	It("gives up when the retry budget is exhausted", func() {
+		for i := 0; i < patchBackoff.Steps; i++ {
+			fKubeClient.PatchErrors = append(fKubeClient.PatchErrors, errors.NewInternalError(fmt.Errorf("etcd is down")))
+		}
+		err := SetNetworkStatus(kc, netStatus)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("etcd is down"))
+		Expect(fKubeClient.PatchCount).To(Equal(patchBackoff.Steps))
+	})
+
+	It("rejects the status of another pod incarnation", func() {
+		kc.PodUID = "old-uid"
+		err := SetNetworkStatus(kc, netStatus)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Precondition failed"))
+		Expect(fKubeClient.PatchCount).To(Equal(1))
+
+		kc.PodUID = "testpod-uid"
+		Expect(SetNetworkStatus(kc, netStatus)).To(Succeed())
+	})
+
+	It("does not retry permanent errors", func() {
+		fKubeClient.PatchErrors = []error{errors.NewForbidden(podResource, "testpod", fmt.Errorf("denied"))}
+		Expect(SetNetworkStatus(kc, netStatus)).NotTo(Succeed())
+		Expect(fKubeClient.PatchCount).To(Equal(1))
+	})
+})
+
+var _ = Describe("k8sclient pod UID", func() {
+	var fKubeClient *testutils.FakeKubeClient
+	var backoff wait.Backoff
+
+	BeforeEach(func() {
+		backoff = getPodBackoff
+		getPodBackoff.Duration = time.Millisecond
+		fakePod := testutils.NewFakePod("testpod", "net1")
+		fakePod.UID = "testpod-uid"
+		fKubeClient = testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+	})
+
+	AfterEach(func() {
+		getPodBackoff = backoff
+	})
+
+	It("accepts K8S_POD_UID", func() {
+		k8sArgs, err := GetK8sArgs(&skel.CmdArgs{
+			Args: "K8S_POD_NAME=testpod;K8S_POD_NAMESPACE=test;K8S_POD_UID=testpod-uid",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(k8sArgs.K8S_POD_UID)).To(Equal("testpod-uid"))
+
+		pod, err := getPodNetworkAnnotation(fKubeClient, k8sArgs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[CNINetworksAnnotation]).To(Equal("net1"))
+		Expect(fKubeClient.PodCount).To(Equal(1))
+	})
+
+	It("fails after retries when the pod was recreated", func() {
+		k8sArgs := &types.K8sArgs{
+			K8S_POD_NAME:      "testpod",
+			K8S_POD_NAMESPACE: "test",
+			K8S_POD_UID:       "new-uid",
+		}
+		_, err := getPodNetworkAnnotation(fKubeClient, k8sArgs)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("UID mismatch: expect new-uid, got testpod-uid"))
+		Expect(fKubeClient.PodCount).To(Equal(getPodBackoff.Steps))
+	})
+
+	It("counts transient errors and UID retries against the same backoff", func() {
+		fKubeClient.GetPodErrors = []error{errors.NewServiceUnavailable("apiserver is down")}
+		_, err := getPod(fKubeClient, "test", "testpod", "new-uid")
+		Expect(err).To(MatchError(ContainSubstring("UID mismatch")))
+		// the fake only counts the GETs which return the pod
+		Expect(fKubeClient.PodCount).To(Equal(getPodBackoff.Steps - 1))
+	})
+
+	It("does not check the UID if kubelet does not pass it", func() {
+		k8sArgs := &types.K8sArgs{
+			K8S_POD_NAME:      "testpod",
+			K8S_POD_NAMESPACE: "test",
+		}
+		_, err := getPodNetworkAnnotation(fKubeClient, k8sArgs)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("k8sclient apiserver fallback", func() {
+	var fKubeClient *testutils.FakeKubeClient
+	var tmpDir string
+	var k8sArgs *types.K8sArgs
+	var backoff wait.Backoff
+	var unavailable []error
+
+	loadNetConf := func(fallback string) *types.NetConf {
+		netConf, err := conf.LoadNetConf([]byte(fmt.Sprintf(`{
+    "name": "multus-cni",
+    "type": "multus",
+    "apiserverFallback": %q,
+    "annotationCacheDir": %q,
+    "defaultDelegates": "default-net",
+    "delegates": [
+        {"name": "default-net", "type": "bridge", "cniVersion": "0.3.1"},
+        {"name": "net1", "type": "macvlan", "cniVersion": "0.3.1"}
+    ]
+}`, fallback, tmpDir)), false)
+		Expect(err).NotTo(HaveOccurred())
+		return netConf
+	}
+
+	BeforeEach(func() {
+		backoff = getPodBackoff
+		getPodBackoff.Duration = time.Millisecond
+		unavailable = nil
+		for i := 0; i < getPodBackoff.Steps; i++ {
+			unavailable = append(unavailable, errors.NewServiceUnavailable("apiserver is down"))
+		}
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		fakePod := testutils.NewFakePod("testpod", "net1")
+		fakePod.UID = "testpod-uid"
+		fKubeClient = testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		k8sArgs = &types.K8sArgs{
+			K8S_POD_NAME:      "testpod",
+			K8S_POD_NAMESPACE: "test",
+			K8S_POD_UID:       "testpod-uid",
+		}
+	})
+
+	AfterEach(func() {
+		getPodBackoff = backoff
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("retries transient errors", func() {
+		netConf := loadNetConf("")
+		fKubeClient.GetPodErrors = unavailable[1:]
+		num, kc, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(1))
+		Expect(kc.Fallback).To(BeEmpty())
+	})
+
+	It("fails by default", func() {
+		netConf := loadNetConf("")
+		Expect(netConf.ApiserverFallback).To(Equal(types.ApiserverFallbackFail))
+		fKubeClient.GetPodErrors = unavailable
+		_, _, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("apiserver is unavailable"))
+	})
+
+	It("does not fall back if the pod does not exist", func() {
+		netConf := loadNetConf(types.ApiserverFallbackDefaultDelegates)
+		fKubeClient.GetPodErrors = []error{errors.NewNotFound(schema.GroupResource{Resource: "pods"}, "testpod")}
+		_, _, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("uses the default delegates", func() {
+		netConf := loadNetConf(types.ApiserverFallbackDefaultDelegates)
+		fKubeClient.GetPodErrors = unavailable
+		num, kc, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(1))
+		Expect(netConf.Delegates[0].Name()).To(Equal("default-net"))
+		Expect(kc.Fallback).To(Equal(types.ApiserverFallbackDefaultDelegates))
+
+		Expect(SetNetworkStatus(kc, []*types.NetworkStatus{{Name: "default-net"}})).To(Succeed())
+		pod, err := fKubeClient.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[CNINetworksStatusAnnotation]).To(ContainSubstring(`"fallback": "defaultDelegates"`))
+	})
+
+	It("uses the last seen annotation of the pod", func() {
+		netConf := loadNetConf(types.ApiserverFallbackCache)
+		_, kc, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kc.Fallback).To(BeEmpty())
+
+		netConf = loadNetConf(types.ApiserverFallbackCache)
+		fKubeClient.GetPodErrors = unavailable
+		num, kc, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(1))
+		Expect(netConf.Delegates[0].Name()).To(Equal("net1"))
+		Expect(kc.Fallback).To(Equal(types.ApiserverFallbackCache))
+	})
+
+	It("fails if the pod is not in the annotation cache", func() {
+		netConf := loadNetConf(types.ApiserverFallbackCache)
+		fKubeClient.GetPodErrors = unavailable
+		_, _, err := TryLoadK8sDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to load the annotation cache of pod testpod-uid"))
+	})
+})
+
+var _ = Describe("k8sclient DEL recovery", func() {
+	var fKubeClient *testutils.FakeKubeClient
+	var k8sArgs *types.K8sArgs
+
+	loadNetConf := func(delOnly string) *types.NetConf {
+		netConf, err := conf.LoadNetConf([]byte(fmt.Sprintf(`{
+    "name": "multus-cni",
+    "type": "multus",
+    "recoverDel": true,
+    "defaultDelegates": "default-net",
+    "delOnlyDelegates": %q,
+    "delegates": [
+        {"name": "default-net", "type": "bridge", "cniVersion": "0.3.1"},
+        {"name": "net1", "type": "macvlan", "cniVersion": "0.3.1"},
+        {"name": "net2", "type": "ipvlan", "cniVersion": "0.3.1"}
+    ]
+}`, delOnly)), false)
+		Expect(err).NotTo(HaveOccurred())
+		return netConf
+	}
+
+	BeforeEach(func() {
+		fakePod := testutils.NewFakePod("testpod", "net1")
+		fakePod.UID = "testpod-uid"
+		fKubeClient = testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		k8sArgs = &types.K8sArgs{
+			K8S_POD_NAME:      "testpod",
+			K8S_POD_NAMESPACE: "test",
+			K8S_POD_UID:       "testpod-uid",
+		}
+	})
+
+	It("loads the networks of the pod if it exists", func() {
+		netConf := loadNetConf("net2")
+		num, kc, err := TryLoadDelDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(1))
+		Expect(kc.PodUID).To(BeEquivalentTo("testpod-uid"))
+		Expect(netConf.Delegates[0].Name()).To(Equal("net1"))
+	})
+
+	It("loads the DEL only networks if the pod is gone", func() {
+		netConf := loadNetConf("net2")
+		k8sArgs.K8S_POD_NAME = "gone"
+		num, kc, err := TryLoadDelDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(1))
+		Expect(kc).To(BeNil())
+		Expect(netConf.Delegates[0].Name()).To(Equal("net2"))
+		Expect(netConf.Delegates[0].MasterPlugin).To(BeTrue())
+
+		// the pod is recreated, its networks may differ
+		netConf = loadNetConf("")
+		k8sArgs.K8S_POD_NAME = "testpod"
+		k8sArgs.K8S_POD_UID = "old-uid"
+		_, _, err = TryLoadDelDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.Delegates[0].Name()).To(Equal("default-net"))
+	})
+
+	It("fails if the pod is unknown", func() {
+		netConf := loadNetConf("net2")
+		fKubeClient.GetPodErrors = []error{errors.NewForbidden(schema.GroupResource{Resource: "pods"}, "testpod", fmt.Errorf("denied"))}
+		_, _, err := TryLoadDelDelegates(k8sArgs, netConf, fKubeClient)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("k8sclient tokens", func() {
+	var tmpDir string
+
+	jwt := func(exp time.Time) string {
+		claims := fmt.Sprintf(`{"iss":"kubernetes/serviceaccount","exp":%d}`, exp.Unix())
+		return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+
+	writeKubeconfig := func(user string) string {
+		kubeconfig := filepath.Join(tmpDir, "kubeconfig")
+		Expect(ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: local
+  cluster:
+    server: https://127.0.0.1:6443
+    insecure-skip-tls-verify: true
+contexts:
+- name: multus
+  context:
+    cluster: local
+    user: multus
+current-context: multus
+users:
+- name: multus
+  user:
+`+user), 0600)).To(Succeed())
+		return kubeconfig
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("checks the expiry of JWT tokens only", func() {
+		Expect(checkTokenExpiry(jwt(time.Now().Add(time.Hour)), "test")).To(Succeed())
+		Expect(checkTokenExpiry("legacy-static-token", "test")).To(Succeed())
+		err := checkTokenExpiry(jwt(time.Now().Add(-time.Hour)), "test")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("the token of test expired at"))
+	})
+
+	It("reads the token file of the kubeconfig", func() {
+		tokenFile := filepath.Join(tmpDir, "token")
+		kubeconfig := writeKubeconfig("    tokenFile: " + tokenFile + "\n")
+
+		Expect(ioutil.WriteFile(tokenFile, []byte(jwt(time.Now().Add(-time.Hour))), 0600)).To(Succeed())
+		_, err := GetK8sClient(&types.NetConf{Kubeconfig: kubeconfig}, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("expired"))
+
+		// the rotated token is picked up by the next invocation
+		Expect(ioutil.WriteFile(tokenFile, []byte(jwt(time.Now().Add(time.Hour))), 0600)).To(Succeed())
+		_, err = GetK8sClient(&types.NetConf{Kubeconfig: kubeconfig}, nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("prefers the tokenFile option over the kubeconfig token", func() {
+		kubeconfig := writeKubeconfig("    token: " + jwt(time.Now().Add(-time.Hour)) + "\n")
+		tokenFile := filepath.Join(tmpDir, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte(jwt(time.Now().Add(time.Hour))+"\n"), 0600)).To(Succeed())
+
+		_, err := GetK8sClient(&types.NetConf{Kubeconfig: kubeconfig}, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = GetK8sClient(&types.NetConf{Kubeconfig: kubeconfig, TokenFile: tokenFile}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = GetK8sClient(&types.NetConf{Kubeconfig: kubeconfig, TokenFile: filepath.Join(tmpDir, "missing")}, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to read token file"))
+	})
+})
+
+var _ = Describe("k8sclient pod cache", func() {
+	var tmpDir, socket string
+	var fKubeClient *testutils.FakeKubeClient
+	var stopCh chan struct{}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		socket = filepath.Join(tmpDir, "podcache.sock")
+		fKubeClient = testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(testutils.NewFakePod("testpod", "net1"))
+		stopCh = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("falls back to the apiserver without the daemon", func() {
+		client := newPodCacheClient(socket, fKubeClient)
+		pod, err := client.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[CNINetworksAnnotation]).To(Equal("net1"))
+		Expect(fKubeClient.PodCount).To(Equal(1))
+	})
+
+	It("reads pods from the daemon", func() {
+		cachedPod := testutils.NewFakePod("testpod", "net1,net2")
+		cachedPod.UID = "testpod-uid"
+		cache := podcache.NewCache(&staticPodSource{pods: []v1.Pod{*cachedPod}})
+		go cache.Run(stopCh)
+		go podcache.Serve(socket, cache, stopCh)
+		Eventually(cache.Synced).Should(BeTrue())
+
+		client := newPodCacheClient(socket, fKubeClient)
+		Eventually(func() (string, error) {
+			pod, err := client.GetPod("test", "testpod")
+			if err != nil {
+				return "", err
+			}
+			return pod.Annotations[CNINetworksAnnotation], nil
+		}).Should(Equal("net1,net2"))
+		Expect(fKubeClient.PodCount).To(Equal(0))
+
+		// pods unknown to the daemon are read from the apiserver
+		fKubeClient.AddPod(testutils.NewFakePod("newpod", "net3"))
+		pod, err := client.GetPod("test", "newpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[CNINetworksAnnotation]).To(Equal("net3"))
+		Expect(fKubeClient.PodCount).To(Equal(1))
+
+		// writes always go to the apiserver
+		Expect(SetNetworkStatus(&clientInfo{Client: client, Podnamespace: "test", Podname: "testpod"}, nil)).To(Succeed())
+		Expect(fKubeClient.PatchCount).To(Equal(1))
+	})
+
+	It("reads a recreated pod from the apiserver", func() {
+		oldPod := testutils.NewFakePod("testpod", "net1")
+		oldPod.UID = "old-uid"
+		cache := podcache.NewCache(&staticPodSource{pods: []v1.Pod{*oldPod}})
+		go cache.Run(stopCh)
+		go podcache.Serve(socket, cache, stopCh)
+		Eventually(cache.Synced).Should(BeTrue())
+
+		newPod := testutils.NewFakePod("testpod", "net2")
+		newPod.UID = "new-uid"
+		fKubeClient.AddPod(newPod)
+		client := newPodCacheClient(socket, fKubeClient)
+		Eventually(func() (k8stypes.UID, error) {
+			pod, err := client.GetPod("test", "testpod")
+			if err != nil {
+				return "", err
+			}
+			return pod.UID, nil
+		}).Should(Equal(k8stypes.UID("old-uid")))
+
+		fKubeClient.PodCount = 0
+		pod, err := getPod(client, "test", "testpod", "new-uid")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pod.Annotations[CNINetworksAnnotation]).To(Equal("net2"))
+		Expect(fKubeClient.PodCount).To(Equal(1))
+	})
+})
+
+// staticPodSource lists fixed pods and never sends watch events
+type staticPodSource struct {
+	pods []v1.Pod
+}
+
+func (s *staticPodSource) List() (*v1.PodList, error) {
+	return &v1.PodList{Items: s.pods}, nil
+}
+
+func (s *staticPodSource) Watch(resourceVersion string) (watch.Interface, error) {
+	return watch.NewFake(), nil
+}
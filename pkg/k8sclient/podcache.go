@@ -0,0 +1,96 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+	"github.com/qyzhaoxun/multus-cni/pkg/podcache"
+)
+
+// podCacheTimeout bounds a request to the pod cache daemon, the apiserver is
+// asked if the daemon does not answer in time
+const podCacheTimeout = time.Second
+
+// podCacheClient reads pods from the node pod cache daemon and falls back to
+// the apiserver client, which is also used for all writes
+type podCacheClient struct {
+	KubeClient
+	socket string
+	client *http.Client
+}
+
+// podCacheClient implements KubeClient
+var _ KubeClient = &podCacheClient{}
+
+func newPodCacheClient(socket string, apiserver KubeClient) *podCacheClient {
+	return &podCacheClient{
+		KubeClient: apiserver,
+		socket:     socket,
+		client: &http.Client{
+			Timeout: podCacheTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (c *podCacheClient) GetPod(namespace, name string) (*v1.Pod, error) {
+	pod, err := c.getCachedPod(namespace, name)
+	if err == nil {
+		return pod, nil
+	}
+	logging.Debugf("podCacheClient: %v, get pod %s/%s from apiserver", err, namespace, name)
+	return c.KubeClient.GetPod(namespace, name)
+}
+
+// apiserverClient returns the client reading pods from the apiserver, past
+// the pod cache of client if any
+func apiserverClient(client KubeClient) KubeClient {
+	if c, ok := client.(*podCacheClient); ok {
+		return c.KubeClient
+	}
+	return client
+}
+
+func (c *podCacheClient) getCachedPod(namespace, name string) (*v1.Pod, error) {
+	// the host is ignored by the unix socket dialer
+	resp, err := c.client.Get("http://podcache" + podcache.PodsPath + namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pod cache %s returns %s", c.socket, resp.Status)
+	}
+	pod := &v1.Pod{}
+	if err := json.NewDecoder(resp.Body).Decode(pod); err != nil {
+		return nil, fmt.Errorf("failed to decode pod from pod cache %s: %v", c.socket, err)
+	}
+	return pod, nil
+}
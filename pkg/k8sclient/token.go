@@ -0,0 +1,74 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// loadToken reads the bearer token from file, it is read on every multus
+// invocation so rotated tokens are picked up without rewriting the kubeconfig
+func loadToken(tokenFile string) (string, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file %s: %v", tokenFile, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", tokenFile)
+	}
+	return token, nil
+}
+
+// checkTokenExpiry fails if the token is a JWT whose exp claim has passed.
+// Tokens which are not JWTs or have no exp claim, such as legacy service
+// account tokens, never expire.
+func checkTokenExpiry(token, source string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return nil
+	}
+
+	expiry := time.Unix(claims.Exp, 0)
+	if time.Now().After(expiry) {
+		return fmt.Errorf("the token of %s expired at %s, make sure the token file is refreshed", source, expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// explainUnauthorized points at the token when the apiserver rejects it
+func explainUnauthorized(err error) error {
+	if err != nil && errors.IsUnauthorized(err) {
+		return fmt.Errorf("%v, the token may be expired or revoked", err)
+	}
+	return err
+}
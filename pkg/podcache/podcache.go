@@ -0,0 +1,284 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podcache
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/logging"
+)
+
+const (
+	DefaultSocket = "/var/run/multus/podcache.sock"
+
+	// PodsPath is the url path prefix of the pods, followed by namespace/name
+	PodsPath = "/pods/"
+
+	// relistInterval is the wait before listing again after the watch failed
+	relistInterval = time.Second
+
+	// the apiserver ends a list after listTimeout and a watch after
+	// minWatchTimeout to twice that, the client itself has no timeout
+	listTimeout     = time.Minute
+	minWatchTimeout = 5 * time.Minute
+)
+
+// PodSource lists and watches the pods scheduled to one node
+type PodSource interface {
+	List() (*v1.PodList, error)
+	Watch(resourceVersion string) (watch.Interface, error)
+}
+
+type nodePodSource struct {
+	client   kubernetes.Interface
+	selector string
+}
+
+// NewNodePodSource returns the source of the pods scheduled to nodeName
+func NewNodePodSource(client kubernetes.Interface, nodeName string) PodSource {
+	return &nodePodSource{
+		client:   client,
+		selector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	}
+}
+
+func (s *nodePodSource) List() (*v1.PodList, error) {
+	timeoutSeconds := int64(listTimeout.Seconds())
+	return s.client.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector:  s.selector,
+		TimeoutSeconds: &timeoutSeconds,
+	})
+}
+
+// Watch watches the pods from resourceVersion, the timeout is randomized so
+// the daemons of the nodes do not watch again at once
+func (s *nodePodSource) Watch(resourceVersion string) (watch.Interface, error) {
+	timeoutSeconds := int64(minWatchTimeout.Seconds() * (rand.Float64() + 1.0))
+	return s.client.CoreV1().Pods("").Watch(metav1.ListOptions{
+		FieldSelector:   s.selector,
+		ResourceVersion: resourceVersion,
+		TimeoutSeconds:  &timeoutSeconds,
+	})
+}
+
+// Cache keeps the metadata of the pods of a node up to date
+type Cache struct {
+	source PodSource
+
+	mu     sync.RWMutex
+	pods   map[string]*v1.Pod
+	synced bool
+}
+
+func NewCache(source PodSource) *Cache {
+	return &Cache{
+		source: source,
+		pods:   make(map[string]*v1.Pod),
+	}
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// trimPod keeps only what multus reads from the pod
+func trimPod(pod *v1.Pod) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			Annotations:     pod.Annotations,
+		},
+	}
+}
+
+// Get returns the cached pod, it is not found until the cache is synced
+func (c *Cache) Get(namespace, name string) (*v1.Pod, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	pod, ok := c.pods[podKey(namespace, name)]
+	return pod, ok
+}
+
+// Synced reports whether the pods were listed at least once
+func (c *Cache) Synced() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.synced
+}
+
+func (c *Cache) replace(pods []v1.Pod) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pods = make(map[string]*v1.Pod)
+	for i := range pods {
+		c.pods[podKey(pods[i].Namespace, pods[i].Name)] = trimPod(&pods[i])
+	}
+	c.synced = true
+}
+
+func (c *Cache) update(eventType watch.EventType, pod *v1.Pod) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := podKey(pod.Namespace, pod.Name)
+	if eventType == watch.Deleted {
+		// a newer incarnation may already be cached
+		if cached, ok := c.pods[key]; ok && cached.UID == pod.UID {
+			delete(c.pods, key)
+		}
+		return
+	}
+	c.pods[key] = trimPod(pod)
+}
+
+// Run lists and watches the pods until stopCh is closed
+func (c *Cache) Run(stopCh <-chan struct{}) {
+	for {
+		if err := c.listAndWatch(stopCh); err != nil {
+			logging.Errorf("podcache: %v, list again in %v", err, relistInterval)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(relistInterval):
+		}
+	}
+}
+
+func (c *Cache) listAndWatch(stopCh <-chan struct{}) error {
+	list, err := c.source.List()
+	if err != nil {
+		return logging.Errorf("failed to list pods: %v", err)
+	}
+	c.replace(list.Items)
+	logging.Infof("podcache: listed %d pods at resource version %s", len(list.Items), list.ResourceVersion)
+
+	resourceVersion := list.ResourceVersion
+	for {
+		w, err := c.source.Watch(resourceVersion)
+		if err != nil {
+			return logging.Errorf("failed to watch pods: %v", err)
+		}
+		resourceVersion, err = c.handleEvents(w, resourceVersion, stopCh)
+		w.Stop()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-stopCh:
+			return nil
+		default:
+		}
+	}
+}
+
+// handleEvents applies the events until the watch ends, it returns the last
+// seen resource version to watch from again
+func (c *Cache) handleEvents(w watch.Interface, resourceVersion string, stopCh <-chan struct{}) (string, error) {
+	for {
+		select {
+		case <-stopCh:
+			return resourceVersion, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return resourceVersion, nil
+			}
+			if event.Type == watch.Error {
+				// most likely the resource version is too old
+				return resourceVersion, logging.Errorf("watch error: %+v", event.Object)
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				return resourceVersion, logging.Errorf("unexpected watch object %T", event.Object)
+			}
+			c.update(event.Type, pod)
+			resourceVersion = pod.ResourceVersion
+		}
+	}
+}
+
+// ServeHTTP serves GET /pods/<namespace>/<name>. Unknown pods are not found,
+// and the cache is unavailable until synced, clients go to the apiserver then.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, PodsPath) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, PodsPath), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if !c.Synced() {
+		http.Error(w, "pod cache is not synced", http.StatusServiceUnavailable)
+		return
+	}
+
+	pod, ok := c.Get(parts[0], parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pod); err != nil {
+		logging.Errorf("podcache: failed to write pod %s/%s: %v", parts[0], parts[1], err)
+	}
+}
+
+// Serve serves the cache on the unix socket until stopCh is closed. The
+// socket is only accessible by root, like the cni binaries.
+func Serve(socket string, cache *Cache, stopCh <-chan struct{}) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return logging.Errorf("podcache: failed to create socket dir: %v", err)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return logging.Errorf("podcache: failed to remove stale socket %s: %v", socket, err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return logging.Errorf("podcache: failed to listen on %s: %v", socket, err)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return logging.Errorf("podcache: failed to chmod %s: %v", socket, err)
+	}
+
+	server := &http.Server{Handler: cache}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+	logging.Infof("podcache: serving on %s", socket)
+	if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+		return logging.Errorf("podcache: %v", err)
+	}
+	return nil
+}
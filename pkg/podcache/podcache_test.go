@@ -0,0 +1,143 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPodCache(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "podcache")
+}
+
+type fakePodSource struct {
+	pods    []v1.Pod
+	watcher *watch.FakeWatcher
+	// resource versions the watches started from
+	watches []string
+}
+
+func (s *fakePodSource) List() (*v1.PodList, error) {
+	return &v1.PodList{
+		ListMeta: metav1.ListMeta{ResourceVersion: "10"},
+		Items:    s.pods,
+	}, nil
+}
+
+func (s *fakePodSource) Watch(resourceVersion string) (watch.Interface, error) {
+	s.watches = append(s.watches, resourceVersion)
+	return s.watcher, nil
+}
+
+func newPod(name, uid, resourceVersion, networks string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "test",
+			UID:             types.UID(uid),
+			ResourceVersion: resourceVersion,
+			Annotations:     map[string]string{"tke.cloud.tencent.com/networks": networks},
+		},
+		Spec: v1.PodSpec{NodeName: "node1"},
+	}
+}
+
+var _ = Describe("podcache", func() {
+	var source *fakePodSource
+	var cache *Cache
+	var stopCh chan struct{}
+
+	BeforeEach(func() {
+		source = &fakePodSource{
+			pods:    []v1.Pod{*newPod("pod1", "uid1", "5", "net1")},
+			watcher: watch.NewFake(),
+		}
+		cache = NewCache(source)
+		stopCh = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+	})
+
+	It("keeps the pod metadata up to date", func() {
+		Expect(cache.Synced()).To(BeFalse())
+		go cache.listAndWatch(stopCh)
+		Eventually(cache.Synced).Should(BeTrue())
+
+		pod, ok := cache.Get("test", "pod1")
+		Expect(ok).To(BeTrue())
+		Expect(pod.Annotations["tke.cloud.tencent.com/networks"]).To(Equal("net1"))
+		Expect(pod.Spec.NodeName).To(BeEmpty())
+
+		source.watcher.Add(newPod("pod2", "uid2", "11", "net2"))
+		source.watcher.Modify(newPod("pod1", "uid1", "12", "net1,net2"))
+		Eventually(func() string {
+			pod, _ := cache.Get("test", "pod1")
+			return pod.Annotations["tke.cloud.tencent.com/networks"]
+		}).Should(Equal("net1,net2"))
+		_, ok = cache.Get("test", "pod2")
+		Expect(ok).To(BeTrue())
+
+		// the delete of an old incarnation does not remove the new one
+		source.watcher.Modify(newPod("pod2", "uid3", "13", "net3"))
+		source.watcher.Delete(newPod("pod2", "uid2", "14", "net2"))
+		source.watcher.Delete(newPod("pod1", "uid1", "15", "net1,net2"))
+		Eventually(func() bool {
+			_, ok := cache.Get("test", "pod1")
+			return ok
+		}).Should(BeFalse())
+		pod, ok = cache.Get("test", "pod2")
+		Expect(ok).To(BeTrue())
+		Expect(string(pod.UID)).To(Equal("uid3"))
+		Expect(source.watches).To(Equal([]string{"10"}))
+	})
+
+	It("serves pods once synced", func() {
+		server := httptest.NewServer(cache)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + PodsPath + "test/pod1")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		cache.replace(source.pods)
+		resp, err = http.Get(server.URL + PodsPath + "test/pod1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		pod := &v1.Pod{}
+		Expect(json.NewDecoder(resp.Body).Decode(pod)).To(Succeed())
+		resp.Body.Close()
+		Expect(string(pod.UID)).To(Equal("uid1"))
+
+		resp, err = http.Get(server.URL + PodsPath + "test/missing")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
@@ -16,12 +16,16 @@
 package testing
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"strings"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 
 	. "github.com/onsi/gomega"
 )
@@ -31,6 +35,13 @@ type FakeKubeClient struct {
 	PodCount int
 	nets     map[string]string
 	NetCount int
+	Events   []*v1.Event
+	// GetPodErrors are returned by the first GetPod calls in order
+	GetPodErrors []error
+	// PatchCount counts the PatchPodStatus calls, PatchErrors are returned
+	// by the first calls in order
+	PatchCount  int
+	PatchErrors []error
 }
 
 func NewFakeKubeClient() *FakeKubeClient {
@@ -51,9 +62,16 @@ func (f *FakeKubeClient) GetRawWithPath(path string) ([]byte, error) {
 
 func (f *FakeKubeClient) GetPod(namespace, name string) (*v1.Pod, error) {
 	key := fmt.Sprintf("%s/%s", namespace, name)
+	if len(f.GetPodErrors) > 0 {
+		err := f.GetPodErrors[0]
+		f.GetPodErrors = f.GetPodErrors[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
 	pod, ok := f.pods[key]
 	if !ok {
-		return nil, fmt.Errorf("pod not found")
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
 	}
 	f.PodCount++
 	return pod, nil
@@ -65,6 +83,59 @@ func (f *FakeKubeClient) UpdatePodStatus(pod *v1.Pod) (*v1.Pod, error) {
 	return f.pods[key], nil
 }
 
+// PatchPodStatus only understands merge patches of the pod annotations
+func (f *FakeKubeClient) PatchPodStatus(namespace, name string, pt types.PatchType, data []byte) (*v1.Pod, error) {
+	f.PatchCount++
+	if len(f.PatchErrors) > 0 {
+		err := f.PatchErrors[0]
+		f.PatchErrors = f.PatchErrors[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pt != types.MergePatchType {
+		return nil, fmt.Errorf("unsupported patch type %s", pt)
+	}
+
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	pod, ok := f.pods[key]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+	}
+
+	patch := struct {
+		Metadata struct {
+			UID         types.UID          `json:"uid"`
+			Annotations map[string]*string `json:"annotations"`
+		} `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	if patch.Metadata.UID != "" && patch.Metadata.UID != pod.UID {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "pods"}, name,
+			fmt.Errorf("Precondition failed: UID in precondition: %s, UID in object meta: %s", patch.Metadata.UID, pod.UID))
+	}
+	pod = pod.DeepCopy()
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	for k, v := range patch.Metadata.Annotations {
+		if v == nil {
+			delete(pod.Annotations, k)
+			continue
+		}
+		pod.Annotations[k] = *v
+	}
+	f.pods[key] = pod
+	return pod, nil
+}
+
+func (f *FakeKubeClient) CreateEvent(event *v1.Event) (*v1.Event, error) {
+	f.Events = append(f.Events, event)
+	return event, nil
+}
+
 func (f *FakeKubeClient) AddPod(pod *v1.Pod) {
 	key := fmt.Sprintf("%s/%s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	f.pods[key] = pod
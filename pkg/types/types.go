@@ -16,8 +16,10 @@
 package types
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
@@ -36,6 +38,14 @@ type NetConf struct {
 	CNIDir  string `json:"cniDir"`
 	BinDir  string `json:"binDir"`
 
+	// VersionCacheFile caches the CNI versions supported by the plugin
+	// binaries, it is hidden in CNIDir by default
+	VersionCacheFile string `json:"versionCacheFile,omitempty"`
+
+	// RawDelegates holds the delegate networks embedded in the multus config,
+	// each one a complete .conf or .conflist object. They are looked up by
+	// name like the network files in ConfDir.
+	RawDelegates     []json.RawMessage      `json:"delegates,omitempty"`
 	Delegates        []*DelegateNetConf     `json:"-"`
 	NetStatus        []*NetworkStatus       `json:"-"`
 	Kubeconfig       string                 `json:"kubeconfig"`
@@ -43,8 +53,60 @@ type NetConf struct {
 	LogLevel         string                 `json:"logLevel"`
 	RuntimeConfig    map[string]interface{} `json:"runtimeConfig,omitempty"`
 	DefaultDelegates string                 `json:"defaultDelegates"`
+
+	// ApiserverFallback is the policy to select the pod networks when the
+	// apiserver is unavailable, AnnotationCacheDir keeps the last seen
+	// network annotation of the pods for the cache policy
+	ApiserverFallback  string `json:"apiserverFallback,omitempty"`
+	AnnotationCacheDir string `json:"annotationCacheDir,omitempty"`
+
+	// Settings of the kube client, KubeTimeout is the request timeout in
+	// seconds and KubeProtobuf talks protobuf instead of json
+	KubeTimeout  int     `json:"kubeTimeout,omitempty"`
+	KubeQPS      float32 `json:"kubeQPS,omitempty"`
+	KubeBurst    int     `json:"kubeBurst,omitempty"`
+	KubeProtobuf bool    `json:"kubeProtobuf,omitempty"`
+
+	// TokenFile overrides the token of the kubeconfig, it is read on every
+	// invocation so rotated tokens are picked up
+	TokenFile string `json:"tokenFile,omitempty"`
+
+	// PodCacheSocket is the unix socket of the node pod cache daemon, pods
+	// are read from it before the apiserver
+	PodCacheSocket string `json:"podCacheSocket,omitempty"`
+
+	// KubeletCheckpointFile is the device plugin checkpoint of kubelet, the
+	// devices allocated to the pod are looked up in it
+	KubeletCheckpointFile string `json:"kubeletCheckpointFile,omitempty"`
+
+	// Store is the backend keeping the delegates of the containers in CNIDir
+	Store string `json:"store,omitempty"`
+
+	// RecoverDel rebuilds the delegates of a DEL whose store entry is lost
+	// instead of skipping it, DelOnlyDelegates are torn down if the pod is
+	// gone and default to DefaultDelegates
+	RecoverDel       bool   `json:"recoverDel,omitempty"`
+	DelOnlyDelegates string `json:"delOnlyDelegates,omitempty"`
 }
 
+// Policies to select the pod networks when the apiserver is unavailable
+const (
+	// fail the ADD, the default
+	ApiserverFallbackFail = "fail"
+	// use the defaultDelegates of the multus config
+	ApiserverFallbackDefaultDelegates = "defaultDelegates"
+	// use the last seen network annotation of the pod, keyed by K8S_POD_UID
+	ApiserverFallbackCache = "cache"
+)
+
+// Backends of the delegates store
+const (
+	// one file per container, the default
+	StoreFile = "file"
+	// a single bbolt database
+	StoreBolt = "bolt"
+)
+
 // AddDelegates appends the new delegates to the delegates list
 func (n *NetConf) AddDelegates(newDelegates []*DelegateNetConf) error {
 	n.Delegates = append(n.Delegates, newDelegates...)
@@ -57,13 +119,34 @@ func (n *NetConf) SetDelegates(newDelegates []*DelegateNetConf) error {
 	return nil
 }
 
+// States of a network in the networks-status annotation
+const (
+	// the network is attached to the pod
+	NetworkStateOK = "ok"
+	// the network failed to attach, which failed the whole pod ADD
+	NetworkStateFailed = "failed"
+	// the network was attached but torn down again because a later network failed
+	NetworkStateRolledBack = "rolled-back"
+)
+
+// NetworkStatus is one entry of the networks-status annotation, a delegate
+// which creates several pod interfaces has one entry per interface
 type NetworkStatus struct {
-	Name      string    `json:"name"`
-	Interface string    `json:"interface,omitempty"`
-	IPs       []string  `json:"ips,omitempty"`
-	Mac       string    `json:"mac,omitempty"`
-	Default   bool      `json:"default,omitempty"`
-	DNS       types.DNS `json:"dns,omitempty"`
+	Name      string         `json:"name"`
+	Interface string         `json:"interface,omitempty"`
+	IPs       []string       `json:"ips,omitempty"`
+	CIDRs     []string       `json:"cidrs,omitempty"`
+	Gateways  []string       `json:"gateways,omitempty"`
+	Routes    []*types.Route `json:"routes,omitempty"`
+	Mac       string         `json:"mac,omitempty"`
+	MTU       int            `json:"mtu,omitempty"`
+	Default   bool           `json:"default,omitempty"`
+	DNS       types.DNS      `json:"dns,omitempty"`
+	State     string         `json:"state,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	// Fallback is the apiserver fallback policy the network was selected
+	// by, empty if it was selected from the pod annotation
+	Fallback string `json:"fallback,omitempty"`
 }
 
 type DelegateNetConf struct {
@@ -73,10 +156,29 @@ type DelegateNetConf struct {
 	MasterPlugin   bool   `json:"masterPlugin,omitempty"`
 	ConfListPlugin bool   `json:"confListPlugin,omitempty"`
 
+	// SecondaryCapabilities lists the master only capabilities, such as
+	// portMappings and bandwidth, the network still accepts when it is
+	// attached as a secondary network
+	SecondaryCapabilities []string `json:"secondaryCapabilities,omitempty"`
+
+	// ResourceName is the device plugin resource backing the network, the
+	// device kubelet allocated to the pod is passed to the delegate as
+	// DeviceID
+	ResourceName string `json:"resourceName,omitempty"`
+	DeviceID     string `json:"deviceID,omitempty"`
+
 	// Raw JSON
 	Bytes []byte
 }
 
+// Name returns the network name of the delegate conf or conflist
+func (d *DelegateNetConf) Name() string {
+	if d.ConfListPlugin {
+		return d.ConfList.Name
+	}
+	return d.Conf.Name
+}
+
 func (d *DelegateNetConf) String() string {
 	if d.ConfListPlugin {
 		return fmt.Sprintf("{conf: %+v, ifnameRequest: %s, master: %t}", d.ConfList, d.IfnameRequest, d.MasterPlugin)
@@ -111,4 +213,107 @@ type K8sArgs struct {
 	K8S_POD_NAME               types.UnmarshallableString
 	K8S_POD_NAMESPACE          types.UnmarshallableString
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
+}
+
+// CacheVersion is the format version of the store entries, entries of
+// version 0 are the bare delegates arrays written by older multus
+const CacheVersion = 1
+
+// CacheEntry is the store entry of a container, it describes the pod, the
+// sandbox and every delegate multus added for the container
+type CacheEntry struct {
+	Version      int              `json:"version"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	PodNamespace string           `json:"podNamespace,omitempty"`
+	PodName      string           `json:"podName,omitempty"`
+	PodUID       string           `json:"podUID,omitempty"`
+	Netns        string           `json:"netns,omitempty"`
+	ConfDigest   string           `json:"confDigest,omitempty"`
+	Delegates    []*CacheDelegate `json:"delegates"`
+}
+
+// CacheDelegate is a delegate of the container with the progress and the
+// result of its ADD
+type CacheDelegate struct {
+	IfName string           `json:"ifName"`
+	State  string           `json:"state,omitempty"`
+	Result json.RawMessage  `json:"result,omitempty"`
+	Conf   *DelegateNetConf `json:"conf"`
+}
+
+// Progress of the ADD of a delegate, the entry is saved before a delegate is
+// started and after it is done
+const (
+	// the ADD did not start the delegate
+	DelegateStatePending = "pending"
+	// the ADD started the delegate, it may be partially set up
+	DelegateStateInProgress = "in-progress"
+	// the ADD of the delegate succeeded
+	DelegateStateDone = "done"
+)
+
+// Progress returns the state of the delegate, delegates saved before the
+// progress was recorded are done
+func (d *CacheDelegate) Progress() string {
+	if d.State == "" {
+		return DelegateStateDone
+	}
+	return d.State
+}
+
+// Interrupted tells if the ADD of the entry did not finish all delegates
+func (e *CacheEntry) Interrupted() bool {
+	for _, delegate := range e.Delegates {
+		if delegate.Progress() != DelegateStateDone {
+			return true
+		}
+	}
+	return false
+}
+
+// DropPending removes the delegates the ADD did not start, they have nothing
+// to tear down
+func (e *CacheEntry) DropPending() {
+	var delegates []*CacheDelegate
+	for _, delegate := range e.Delegates {
+		if delegate.Progress() != DelegateStatePending {
+			delegates = append(delegates, delegate)
+		}
+	}
+	e.Delegates = delegates
+}
+
+// DelegateConfs returns the delegate confs in ADD order
+func (e *CacheEntry) DelegateConfs() []*DelegateNetConf {
+	var delegates []*DelegateNetConf
+	for _, delegate := range e.Delegates {
+		delegates = append(delegates, delegate.Conf)
+	}
+	return delegates
+}
+
+// Results returns the ADD results of the delegates in ADD order, nil for a
+// delegate without result
+func (e *CacheEntry) Results() []json.RawMessage {
+	var results []json.RawMessage
+	for _, delegate := range e.Delegates {
+		results = append(results, delegate.Result)
+	}
+	return results
+}
+
+// Retain keeps only the delegates whose conf is in confs
+func (e *CacheEntry) Retain(confs []*DelegateNetConf) {
+	keep := make(map[*DelegateNetConf]bool)
+	for _, conf := range confs {
+		keep[conf] = true
+	}
+	var delegates []*CacheDelegate
+	for _, delegate := range e.Delegates {
+		if keep[delegate.Conf] {
+			delegates = append(delegates, delegate)
+		}
+	}
+	e.Delegates = delegates
 }
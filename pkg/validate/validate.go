@@ -0,0 +1,221 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+
+	"github.com/qyzhaoxun/multus-cni/pkg/conf"
+	"github.com/qyzhaoxun/multus-cni/pkg/types"
+)
+
+const DefaultConfFile = "/etc/cni/net.d/00-multus.conf"
+
+// Validate checks the multus config file and every network file in its
+// confDir, and returns all problems found instead of stopping at the first one
+func Validate(confFile string) []error {
+	var errs []error
+
+	bytes, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return append(errs, fmt.Errorf("failed to read multus config: %v", err))
+	}
+
+	errs = append(errs, checkUnknownFields(bytes)...)
+
+	// the inline delegates are checked one by one below
+	netconf, err := conf.ParseNetConf(bytes)
+	if err != nil {
+		// nothing else can be checked without a valid multus config
+		return append(errs, err)
+	}
+
+	if netconf.Kubeconfig != "" {
+		if _, err := os.Stat(netconf.Kubeconfig); err != nil {
+			errs = append(errs, fmt.Errorf("kubeconfig: %v", err))
+		}
+	}
+	if netconf.TokenFile != "" {
+		if _, err := os.Stat(netconf.TokenFile); err != nil {
+			errs = append(errs, fmt.Errorf("tokenFile: %v", err))
+		}
+	}
+
+	// plugin type => networks using it
+	plugins := make(map[string][]string)
+	addPlugins := func(name string, delegate *types.DelegateNetConf) {
+		if !delegate.ConfListPlugin {
+			plugins[delegate.Conf.Type] = append(plugins[delegate.Conf.Type], name)
+			return
+		}
+		for _, plugin := range delegate.ConfList.Plugins {
+			plugins[plugin.Type] = append(plugins[plugin.Type], name)
+		}
+	}
+
+	delegates, delegateErrs := conf.LoadInlineDelegates(netconf)
+	errs = append(errs, delegateErrs...)
+	for _, delegate := range delegates {
+		addPlugins(delegate.Name(), delegate)
+	}
+
+	networkErrs, networks := checkNetworkFiles(netconf.ConfDir)
+	errs = append(errs, networkErrs...)
+	for _, network := range networks {
+		delegate, err := conf.LoadDelegateNetConf(network.bytes, network.isConfList, "")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", network.file, err))
+			continue
+		}
+		addPlugins(network.file, delegate)
+	}
+
+	if netconf.DefaultDelegates != "" {
+		if _, err := conf.GetDefaultDelegates(netconf); err != nil {
+			errs = append(errs, fmt.Errorf("defaultDelegates %q: %v", netconf.DefaultDelegates, err))
+		}
+	}
+	if netconf.DelOnlyDelegates != "" {
+		if _, err := conf.GetDelOnlyDelegates(netconf); err != nil {
+			errs = append(errs, fmt.Errorf("delOnlyDelegates %q: %v", netconf.DelOnlyDelegates, err))
+		}
+	}
+
+	var pluginTypes []string
+	for pluginType := range plugins {
+		pluginTypes = append(pluginTypes, pluginType)
+	}
+	sort.Strings(pluginTypes)
+	binDirs := conf.GetBinDirs(netconf.BinDir)
+	for _, pluginType := range pluginTypes {
+		if _, err := invoke.FindInPath(pluginType, binDirs); err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s used by %s: %v", pluginType, strings.Join(plugins[pluginType], ", "), err))
+		}
+	}
+
+	return errs
+}
+
+type networkFile struct {
+	file       string
+	isConfList bool
+	bytes      []byte
+}
+
+// checkNetworkFiles parses every network file in confDir the same way multus
+// looks them up by name, and reports files sharing a network name
+func checkNetworkFiles(confDir string) ([]error, []*networkFile) {
+	var errs []error
+	var networks []*networkFile
+
+	files, err := libcni.ConfFiles(confDir, []string{".conf", ".json", ".conflist"})
+	if err != nil {
+		return append(errs, fmt.Errorf("confDir %s: %v", confDir, err)), nil
+	}
+
+	sort.Strings(files)
+	names := make(map[string]string)
+	for _, file := range files {
+		var name string
+		var bytes []byte
+		isConfList := strings.HasSuffix(file, ".conflist")
+		if isConfList {
+			confList, err := libcni.ConfListFromFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", file, err))
+				continue
+			}
+			name, bytes = confList.Name, confList.Bytes
+		} else {
+			netconf, err := libcni.ConfFromFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", file, err))
+				continue
+			}
+			name, bytes = netconf.Network.Name, netconf.Bytes
+		}
+
+		if name == "" {
+			errs = append(errs, fmt.Errorf("%s: missing 'name'", file))
+			continue
+		}
+		if other, ok := names[name]; ok {
+			errs = append(errs, fmt.Errorf("%s: network name %s is already used by %s", file, name, other))
+			continue
+		}
+		names[name] = file
+		networks = append(networks, &networkFile{file: file, isConfList: isConfList, bytes: bytes})
+	}
+
+	return errs, networks
+}
+
+// checkUnknownFields reports the top level fields of the multus config which
+// multus does not know, they are most likely typos. Keys are matched case
+// insensitively like encoding/json does.
+func checkUnknownFields(bytes []byte) []error {
+	var errs []error
+
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return append(errs, fmt.Errorf("failed to parse multus config: %v", err))
+	}
+
+	known := jsonFields(reflect.TypeOf(types.NetConf{}))
+	var keys []string
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[strings.ToLower(key)] {
+			errs = append(errs, fmt.Errorf("unknown field %q", key))
+		}
+	}
+	return errs
+}
+
+// jsonFields returns the lower cased json keys of a struct type, including the
+// keys of its embedded structs
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			for key := range jsonFields(field.Type) {
+				fields[key] = true
+			}
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		fields[strings.ToLower(tag)] = true
+	}
+	return fields
+}
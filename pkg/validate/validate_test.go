@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestValidate(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "validate")
+}
+
+var _ = Describe("validate operations", func() {
+	var tmpDir, confDir, binDir string
+
+	writeFile := func(path, content string, perm os.FileMode) {
+		Expect(ioutil.WriteFile(path, []byte(content), perm)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_tmp")
+		Expect(err).NotTo(HaveOccurred())
+		confDir = filepath.Join(tmpDir, "multus")
+		binDir = filepath.Join(tmpDir, "bin")
+		Expect(os.MkdirAll(confDir, 0755)).To(Succeed())
+		Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+		os.Unsetenv("CNI_PATH")
+
+		writeFile(filepath.Join(binDir, "bridge"), "", 0755)
+		writeFile(filepath.Join(binDir, "portmap"), "", 0755)
+		writeFile(filepath.Join(confDir, "10-bridge.conflist"), `{
+    "name": "tke-bridge",
+    "cniVersion": "0.3.1",
+    "plugins": [{"type": "bridge"}, {"type": "portmap"}]
+}`, 0644)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("accepts a valid multus configuration", func() {
+		confFile := filepath.Join(tmpDir, "00-multus.conf")
+		writeFile(confFile, fmt.Sprintf(`{
+    "name": "multus-cni",
+    "type": "multus",
+    "confDir": %q,
+    "binDir": %q,
+    "LogLevel": "info",
+    "defaultDelegates": "tke-bridge,inline1",
+    "delegates": [{"name": "inline1", "type": "bridge"}]
+}`, confDir, binDir), 0644)
+
+		Expect(Validate(confFile)).To(BeEmpty())
+	})
+
+	It("reports every problem in one run", func() {
+		writeFile(filepath.Join(confDir, "20-bridge.conf"), `{
+    "name": "tke-bridge",
+    "type": "bridge"
+}`, 0644)
+		writeFile(filepath.Join(confDir, "30-broken.conf"), `{
+    "name": "broken"
+}`, 0644)
+		writeFile(filepath.Join(confDir, "40-eni.conf"), `{
+    "name": "tke-eni",
+    "type": "tke-eni-cni"
+}`, 0644)
+		confFile := filepath.Join(tmpDir, "00-multus.conf")
+		writeFile(confFile, fmt.Sprintf(`{
+    "name": "multus-cni",
+    "type": "multus",
+    "confDir": %q,
+    "binDir": %q,
+    "defaultDelegate": "tke-bridge",
+    "defaultDelegates": "missing"
+}`, confDir, binDir), 0644)
+
+		errs := Validate(confFile)
+		Expect(errs).To(HaveLen(5))
+		Expect(errs[0].Error()).To(ContainSubstring(`unknown field "defaultDelegate"`))
+		Expect(errs[1].Error()).To(ContainSubstring("20-bridge.conf: network name tke-bridge is already used by"))
+		Expect(errs[2].Error()).To(ContainSubstring("30-broken.conf"))
+		Expect(errs[3].Error()).To(ContainSubstring(`defaultDelegates "missing"`))
+		Expect(errs[4].Error()).To(ContainSubstring("plugin tke-eni-cni used by"))
+	})
+
+	It("reports the bad inline delegates with the other problems", func() {
+		writeFile(filepath.Join(confDir, "30-broken.conf"), `{
+    "name": "broken"
+}`, 0644)
+		confFile := filepath.Join(tmpDir, "00-multus.conf")
+		writeFile(confFile, fmt.Sprintf(`{
+    "name": "multus-cni",
+    "type": "multus",
+    "confDir": %q,
+    "binDir": %q,
+    "defaultDelegates": "missing",
+    "delegates": [
+        {"type": "bridge"},
+        {"name": "inline1", "type": "macvlan"},
+        {"name": "inline1", "type": "bridge"}
+    ]
+}`, confDir, binDir), 0644)
+
+		errs := Validate(confFile)
+		Expect(errs).To(HaveLen(5))
+		Expect(errs[0].Error()).To(ContainSubstring("invalid delegate 0"))
+		Expect(errs[1].Error()).To(ContainSubstring("delegate 1 and 2 have the same name inline1"))
+		Expect(errs[2].Error()).To(ContainSubstring("30-broken.conf"))
+		Expect(errs[3].Error()).To(ContainSubstring(`defaultDelegates "missing"`))
+		Expect(errs[4].Error()).To(ContainSubstring("plugin macvlan used by inline1"))
+	})
+})
@@ -70,9 +70,25 @@ add_replace_cni_plugins () {
     done
 }
 
+# the token file on the host links to the projected token of this pod, which
+# kubelet refreshes before it expires, and multus reads it on every invocation
+add_cni_token () {
+    local kubeletDir=${KUBELET_ROOT_DIR:-/var/lib/kubelet}
+    local tokenPath=/host/etc/kubernetes/tke-cni-token
+    if [[ -z "${POD_UID}" ]]; then
+        echo "error: POD_UID is not set"
+        exit 1
+    fi
+    if [[ ! -s /var/run/secrets/tke-cni/token ]]; then
+        echo "error: projected token tke-cni-token is not mounted"
+        exit 1
+    fi
+    ln -sfn ${kubeletDir}/pods/${POD_UID}/volumes/kubernetes.io~projected/tke-cni-token/token ${tokenPath}.tmp
+    mv -f ${tokenPath}.tmp ${tokenPath}
+}
+
 add_cni_kubeconfig () {
     local ca=$(cat /var/run/secrets/kubernetes.io/serviceaccount/ca.crt | base64 | xargs | sed 's/ //g')
-    local token=$(cat /var/run/secrets/kubernetes.io/serviceaccount/token)
     local server=https://$KUBERNETES_SERVICE_HOST:$KUBERNETES_SERVICE_PORT
     local tmpPath=./tke-cni-kubeconfig
     local configPath=/host/etc/kubernetes/tke-cni-kubeconfig
@@ -80,10 +96,6 @@ add_cni_kubeconfig () {
         echo "error: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set, services may not be synchronized to the node"
         exit 1
     fi
-    if [[ -z "${token}" ]]; then
-        echo "error: empty token"
-        exit 1
-    fi
 
     skipVerify=0
     if [[ -n "${SKIP_TLS_VERIFY}" ]]; then
@@ -118,7 +130,7 @@ preferences: {}
 users:
 - name: tke-cni
   user:
-    token: ${token}" >> ${tmpPath}
+    tokenFile: /etc/kubernetes/tke-cni-token" >> ${tmpPath}
     add_replace_file ${tmpPath} ${configPath}
 }
 
@@ -130,6 +142,7 @@ fi
 mkdir -p ${dst_dir}
 
 echo "=====Starting install tke-cni-kubeconfig ==========="
+add_cni_token
 add_cni_kubeconfig
 
 echo "=====Starting install multus conf ==========="
@@ -143,14 +156,5 @@ add_replace_cni_plugins
 
 echo "=====Done==========="
 
-if [[ -z "${RESTART_INTERVAL}" ]]; then
-    RESTART_INTERVAL=600
-fi
-
-echo "Reinstall tke-cni-kubeconfig with interval ${RESTART_INTERVAL}s"
-
-while sleep ${RESTART_INTERVAL} 
-do 
-    echo "=====Reinstall tke-cni-kubeconfig ==========="
-    add_cni_kubeconfig 
-done
+# kubelet only refreshes the projected token of a running pod
+exec tail -f /dev/null